@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	MODE_IMPERSONATION = "impersonation"
+	MODE_CERTIFICATE   = "certificate"
+	MODE_FRONTPROXY    = "frontproxy"
+	// Per user ServiceAccounts for clusters without a client certificate signer
+	MODE_SERVICEACCOUNT = "serviceaccount"
+	// Shortest expirationSeconds the Kubernetes CSR API accepts
+	CERTIFICATE_LIFETIME_MINIMUM = time.Minute * 10
+)
+
+// Access groups in priority order. LDAP.Group is kept as the last access group without settings.
+func (auth *LDAPAuth) accessGroups() []AccessGroupConfig {
+	accessGroups := auth.AccessGroups
+	if len(auth.Group) > 0 && !slices.ContainsFunc(accessGroups, func(accessGroup AccessGroupConfig) bool {
+		return accessGroup.Name == auth.Group
+	}) {
+		accessGroups = append(slices.Clone(accessGroups), AccessGroupConfig{Name: auth.Group})
+	}
+	return accessGroups
+}
+
+// Settings of the first configured access group the user is a member of
+func (proxy *Proxy) accessGroup(user *LDAPUser) AccessGroupConfig {
+	for _, accessGroup := range proxy.LDAPAuth.accessGroups() {
+		if slices.Contains(user.AccessGroups, accessGroup.Name) {
+			return accessGroup
+		}
+	}
+	return AccessGroupConfig{}
+}
+
+// Mode of a cluster, the global Mode or Impersonation setting if the cluster has none
+func (config *MainConfig) defaultMode(clusterMode string) string {
+	if len(clusterMode) > 0 {
+		return clusterMode
+	}
+	if len(config.Mode) > 0 {
+		return config.Mode
+	}
+	if config.Impersonation {
+		return MODE_IMPERSONATION
+	}
+	return MODE_CERTIFICATE
+}
+
+// Impersonation, certificate, front-proxy or serviceaccount mode for the user on cluster
+func (proxy *Proxy) userMode(cluster *Cluster, user *LDAPUser) string {
+	if mode := proxy.accessGroup(user).Mode; len(mode) > 0 {
+		return mode
+	}
+	return proxy.Config.defaultMode(cluster.Mode)
+}
+
+// Lifetime of certificates issued for the user, 0 for the default
+func (proxy *Proxy) userCertificateLifetime(user *LDAPUser) time.Duration {
+	return proxy.accessGroup(user).CertificateLifetime
+}
+
+// True if any user can end up in mode on a cluster with clusterMode
+func (config *MainConfig) usesMode(clusterMode string, mode string) bool {
+	if config.defaultMode(clusterMode) == mode {
+		return true
+	}
+	return slices.ContainsFunc(config.LDAP.AccessGroups, func(accessGroup AccessGroupConfig) bool {
+		return accessGroup.Mode == mode
+	})
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", MODE_IMPERSONATION, MODE_CERTIFICATE, MODE_FRONTPROXY, MODE_SERVICEACCOUNT:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %v", mode)
+	}
+}
+
+func (config *MainConfig) validateAccessGroups() error {
+	for _, accessGroup := range config.LDAP.AccessGroups {
+		if len(accessGroup.Name) == 0 {
+			return fmt.Errorf("access group without name")
+		}
+		if err := validateMode(accessGroup.Mode); err != nil {
+			return fmt.Errorf("access group %v: %w", accessGroup.Name, err)
+		}
+		for _, group := range accessGroup.KubernetesGroups {
+			if isReservedIdentity(group) {
+				return fmt.Errorf("access group %v: KubernetesGroups %v is a reserved identity", accessGroup.Name, group)
+			}
+		}
+		if accessGroup.CertificateLifetime != 0 && accessGroup.CertificateLifetime < CERTIFICATE_LIFETIME_MINIMUM {
+			return fmt.Errorf("access group %v: CertificateLifetime %v is shorter than %v", accessGroup.Name, accessGroup.CertificateLifetime, CERTIFICATE_LIFETIME_MINIMUM)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_AccessGroups(t *testing.T) {
+	config := &MainConfig{LDAP: LDAPConfig{
+		Group: "kube-legacy",
+		AccessGroups: []AccessGroupConfig{
+			{Name: "kube-admins", Mode: MODE_IMPERSONATION},
+			{Name: "kube-users", Mode: MODE_CERTIFICATE, CertificateLifetime: time.Hour * 8},
+		},
+	}}
+	proxy := &Proxy{LDAPAuth: &LDAPAuth{LDAPConfig: config.LDAP}, Config: config}
+	cluster := &Cluster{}
+	t.Run("Legacy Group Last", func(t *testing.T) {
+		accessGroups := proxy.LDAPAuth.accessGroups()
+		if len(accessGroups) != 3 || accessGroups[2].Name != "kube-legacy" {
+			t.Errorf("Error: %v", accessGroups)
+		}
+	})
+	t.Run("First Group Wins", func(t *testing.T) {
+		user := &LDAPUser{User: "alice", AccessGroups: []string{"kube-users", "kube-admins"}}
+		if mode := proxy.userMode(cluster, user); mode != MODE_IMPERSONATION {
+			t.Errorf("Error: %v != %v", mode, MODE_IMPERSONATION)
+		}
+		if lifetime := proxy.userCertificateLifetime(user); lifetime != 0 {
+			t.Errorf("Error: %v != 0", lifetime)
+		}
+	})
+	t.Run("Group Settings", func(t *testing.T) {
+		user := &LDAPUser{User: "bob", AccessGroups: []string{"kube-users"}}
+		if mode := proxy.userMode(cluster, user); mode != MODE_CERTIFICATE {
+			t.Errorf("Error: %v != %v", mode, MODE_CERTIFICATE)
+		}
+		if lifetime := proxy.userCertificateLifetime(user); lifetime != time.Hour*8 {
+			t.Errorf("Error: %v != 8h", lifetime)
+		}
+	})
+	t.Run("Default Mode", func(t *testing.T) {
+		config.Impersonation = true
+		user := &LDAPUser{User: "carol", AccessGroups: []string{"kube-legacy"}}
+		if mode := proxy.userMode(cluster, user); mode != MODE_IMPERSONATION {
+			t.Errorf("Error: %v != %v", mode, MODE_IMPERSONATION)
+		}
+		if !config.usesMode("", MODE_CERTIFICATE) {
+			t.Errorf("Error: certificate mode not in use")
+		}
+		cluster.Mode = MODE_CERTIFICATE
+		if mode := proxy.userMode(cluster, user); mode != MODE_CERTIFICATE {
+			t.Errorf("Error: %v != %v", mode, MODE_CERTIFICATE)
+		}
+	})
+	t.Run("Unknown Mode", func(t *testing.T) {
+		invalid := &MainConfig{LDAP: LDAPConfig{AccessGroups: []AccessGroupConfig{{Name: "kube-admins", Mode: "token"}}}}
+		if err := invalid.validateAccessGroups(); err == nil {
+			t.Errorf("Error: unknown mode accepted")
+		}
+	})
+	t.Run("Certificate Lifetime", func(t *testing.T) {
+		for lifetime, valid := range map[time.Duration]bool{
+			0:                 true,
+			time.Minute * 10:  true,
+			time.Hour * 8:     true,
+			time.Minute * 5:   false,
+			time.Second * 30:  false,
+			time.Minute * -10: false,
+		} {
+			config := &MainConfig{LDAP: LDAPConfig{AccessGroups: []AccessGroupConfig{{Name: "kube-users", Mode: MODE_CERTIFICATE, CertificateLifetime: lifetime}}}}
+			if err := config.validateAccessGroups(); (err == nil) != valid {
+				t.Errorf("Error: lifetime %v: %v", lifetime, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+)
+
+// Good documentation:
+// https://learn.microsoft.com/en-us/troubleshoot/windows-server/active-directory/active-directory-user-logon-name
+// https://ldapwiki.com/wiki/Wiki.jsp?page=Common%20Active%20Directory%20Bind%20Errors
+
+const (
+	LDAP_SCHEMA_OPENLDAP        = ""
+	LDAP_SCHEMA_ACTIVEDIRECTORY = "activedirectory"
+	ACTIVEDIRECTORY_USERNAME    = "sAMAccountName"
+)
+
+// Sub codes Active Directory adds to Invalid Credentials (49) as "data <code>"
+var activeDirectoryBindErrors = map[string]string{
+	"525": "user not found",
+	"52e": "invalid credentials",
+	"530": "not permitted to logon at this time",
+	"531": "not permitted to logon at this workstation",
+	"532": "password expired",
+	"533": "account disabled",
+	"568": "too many security IDs",
+	"701": "account expired",
+	"773": "user must reset password",
+	"775": "account locked out",
+}
+
+var activeDirectoryBindErrorCode = regexp.MustCompile(`data ([0-9a-fA-F]{3,4})`)
+
+// Defaults for Active Directory, only used if not set in the configuration
+func setActiveDirectoryDefaults() {
+	viper.SetDefault("LDAP.SearchUserFilter", "(&(objectClass=user)(|(sAMAccountName=%[1]s)(userPrincipalName=%[1]s))(memberOf=%[2]s))")
+	viper.SetDefault("LDAP.SearchLoginFilter", "(&(objectClass=user)(|(sAMAccountName=%[1]s)(userPrincipalName=%[1]s)))")
+	viper.SetDefault("LDAP.SearchGroupFilter", "(&(cn=%s)(objectClass=group))")
+	viper.SetDefault("LDAP.UsernameAttribute", ACTIVEDIRECTORY_USERNAME)
+}
+
+// DOMAIN\user is reduced to user, user@domain.tld is kept for matching userPrincipalName
+func normalizeActiveDirectoryUsername(username string) string {
+	if index := strings.LastIndex(username, `\`); index >= 0 {
+		return username[index+1:]
+	}
+	return username
+}
+
+// Reason for a failed bind from the Active Directory sub code, empty if unknown.
+// Only Invalid Credentials (49) is a failed login, other result codes and connection errors are not.
+func activeDirectoryBindFailure(err error) string {
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ""
+	}
+	match := activeDirectoryBindErrorCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return ""
+	}
+	reason, ok := activeDirectoryBindErrors[strings.ToLower(match[1])]
+	if !ok {
+		return "unknown sub code " + match[1]
+	}
+	return reason
+}
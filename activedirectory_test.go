@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+func Test_ActiveDirectory(t *testing.T) {
+	t.Run("Normalize Username", func(t *testing.T) {
+		for username, expected := range map[string]string{
+			"alice":                 "alice",
+			`EXAMPLE\alice`:         "alice",
+			"alice@example.com":     "alice@example.com",
+			`EXAMPLE\alice@example`: "alice@example",
+		} {
+			if normalized := normalizeActiveDirectoryUsername(username); normalized != expected {
+				t.Errorf("Error: %v normalized to %v, expected %v", username, normalized, expected)
+			}
+		}
+	})
+	t.Run("Bind Failure Reason", func(t *testing.T) {
+		for _, test := range []struct {
+			err    error
+			reason string
+		}{
+			{ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 775, v4563")), "account locked out"},
+			{ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563")), "invalid credentials"},
+			// Not a failed login, must not count against the user
+			{ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("00002077: SvcErr: DSID-03190F80, problem 5003 (WILL_NOT_PERFORM), data 533")), ""},
+			{ldap.NewError(ldap.LDAPResultUnavailable, errors.New("00000000: LdapErr: DSID-0C0906E8, data 52e, v4563")), ""},
+			{ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset, data 775")), ""},
+			{errors.New("connection reset"), ""},
+		} {
+			if reason := activeDirectoryBindFailure(test.err); reason != test.reason {
+				t.Errorf("Error: %v gave %q, expected %q", test.err, reason, test.reason)
+			}
+		}
+	})
+	t.Run("Group Name From DN", func(t *testing.T) {
+		for dn, expected := range map[string]string{
+			"CN=Kube Admins,OU=Groups,DC=example,DC=com":    "Kube Admins",
+			`CN=Team\, Platform,OU=Teams,DC=example,DC=com`: "Team, Platform",
+		} {
+			name, ok := commonNameFromDN(dn)
+			if !ok || name != expected {
+				t.Errorf("Error: %v gave %q, expected %q", dn, name, expected)
+			}
+		}
+		if _, ok := commonNameFromDN("OU=Groups,DC=example,DC=com"); ok {
+			t.Error("Error: name found in DN without CN")
+		}
+	})
+}
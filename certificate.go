@@ -1,17 +1,22 @@
 package main
 
 import (
+	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"net"
+	"slices"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -24,30 +29,38 @@ import (
 // https://gist.github.com/gambol99/d55afd69217b8e2dd727be99f0a20e7d
 
 type Certificate struct {
-	*ecdsa.PrivateKey
+	PrivateKey crypto.Signer
 	*x509.Certificate
-	name     string
-	key      []byte
-	cert     []byte
-	lastUsed time.Time
+	name       string
+	commonName string
+	groups     string
+	lifetime   time.Duration
+	key        []byte
+	cert       []byte
+	lastUsed   time.Time
 }
 
 const (
 	Certificate_Common_Name  = "/CN="
 	Certificate_Organization = "/O="
-	// Types for PEM Conversion
+	// Types for PEM Conversion, keys are written as TYPE_PKCS8_KEY
 	TYPE_PRIV_KEY            = "EC PRIVATE KEY"
 	TYPE_CERTIFICATE_REQUEST = "CERTIFICATE REQUEST"
 	TYPE_CERTIFICATE         = "CERTIFICATE"
 
 	//Secret key for Certificate
-	SECRET_KEY_KEY              = "key"
-	SECRET_KEY_CERT             = "cert"
-	LABLE_KEY                   = "auth.stiil.dk/clientcertificates"
-	LABLE_KEY_GENERATED         = "generated"
+	SECRET_KEY_KEY      = "key"
+	SECRET_KEY_CERT     = "cert"
+	LABLE_KEY           = "auth.stiil.dk/clientcertificates"
+	LABLE_KEY_GENERATED = "generated"
+	// Key of a certificate still waiting for external approval of its CSR
+	LABLE_KEY_PENDING           = "pending"
 	LABLE_VERSION               = "auth.stiil.dk/version"
 	LABLE_EXPIRATION            = "auth.stiil.dk/expiration"
 	LABLE_EXPIRATION_UNASSIGNED = "unknown"
+	ANNOTATION_GROUPS           = "auth.stiil.dk/groups"
+	ANNOTATION_COMMON_NAME      = "auth.stiil.dk/commonname"
+	ANNOTATION_LIFETIME         = "auth.stiil.dk/lifetime"
 	// Time format compliant with kubernetes labels
 	LABEL_TIME_FORMAT = "2006-01-02T15.04.05Z07.00"
 	// Label validator
@@ -57,85 +70,183 @@ const (
 
 // Main Certificate handler function.
 // Get secret, and Convert if available, if not expired use, otherwire reissue a new certificate
-func NewClientAuth(client *KubeClient, name string) (*Certificate, error) {
+func NewClientAuth(client *KubeClient, name string, commonName string, groups []string, lifetime time.Duration) (*Certificate, error) {
 	// Get Secret
 	// TODO : Should have some caching
 	secret, err := client.GetSecret(name)
 	if apierros.IsNotFound(err) {
 		log.Printf("No secret found for user %v creating new certificate\n", name)
-		return NewCertificate(client, name)
+		return NewCertificate(client, name, commonName, groups, lifetime)
 	} else {
-		// Check for Expiration
-		val, ok := secret.Labels[LABLE_EXPIRATION]
-		expired := !ok || val == LABLE_EXPIRATION_UNASSIGNED
-		if !expired {
-			expiration, err := stringToTime(secret.Labels[LABLE_EXPIRATION])
-			expired = time.Now().Add(CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD).After(expiration) || err != nil
+		if secret.Labels[LABLE_KEY] == LABLE_KEY_PENDING {
+			return resumeCertificate(client, secret, name, commonName, groups, lifetime)
 		}
-		if expired {
+		// Check for Expiration
+		if secretAboutToExpire(secret, lifetime) {
 			client.DeleteSecret(name)
 			log.Printf("Secret found for user %v, but expired, creating new certificate\n", name)
-			return NewCertificate(client, name)
+			return NewCertificate(client, name, commonName, groups, lifetime)
+		}
+		// Groups are part of the certificate, so changed groups requires a new one
+		if secret.Annotations[ANNOTATION_GROUPS] != groupsToString(groups) {
+			client.DeleteSecret(name)
+			log.Printf("Secret found for user %v, but groups changed, creating new certificate\n", name)
+			return NewCertificate(client, name, commonName, groups, lifetime)
+		}
+		// Secrets from before the username prefix are issued for their name
+		secretCommonName, ok := secret.Annotations[ANNOTATION_COMMON_NAME]
+		if !ok {
+			secretCommonName = name
+		}
+		if secretCommonName != commonName {
+			client.DeleteSecret(name)
+			log.Printf("Secret found for user %v, but username changed, creating new certificate\n", name)
+			return NewCertificate(client, name, commonName, groups, lifetime)
+		}
+		// Access groups can change the requested lifetime
+		if secret.Annotations[ANNOTATION_LIFETIME] != lifetimeToString(lifetime) {
+			client.DeleteSecret(name)
+			log.Printf("Secret found for user %v, but lifetime changed, creating new certificate\n", name)
+			return NewCertificate(client, name, commonName, groups, lifetime)
 		}
 		log.Printf("Secret for user %v reading certificate\n", name)
-		return CertificateFromSecret(secret)
+		cert, err := CertificateFromSecret(secret)
+		if err != nil {
+			return nil, err
+		}
+		// Keys from before a change of Kubernetes.Key are replaced
+		if !client.keyConfig.matches(cert.PrivateKey) {
+			client.DeleteSecret(name)
+			log.Printf("Secret found for user %v, but key is %v, creating new certificate\n", name, keyDescription(cert.PrivateKey))
+			return NewCertificate(client, name, commonName, groups, lifetime)
+		}
+		cert.commonName = commonName
+		return cert, nil
+	}
+}
+
+// True if the expiration label is missing or within the threshold for lifetime
+func secretAboutToExpire(secret *corev1.Secret, lifetime time.Duration) bool {
+	val, ok := secret.Labels[LABLE_EXPIRATION]
+	if !ok || val == LABLE_EXPIRATION_UNASSIGNED {
+		return true
+	}
+	expiration, err := stringToTime(val)
+	return err != nil || time.Now().Add(expirationThreshold(lifetime)).After(expiration)
+}
+
+// An hour before expiration, or a third of the lifetime for certificates shorter than 3 hours
+func expirationThreshold(lifetime time.Duration) time.Duration {
+	if lifetime > 0 && lifetime/3 < CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD {
+		return lifetime / 3
+	}
+	return CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD
+}
+
+// Sorted comma separated groups for comparing
+func groupsToString(groups []string) string {
+	sorted := slices.Clone(groups)
+	slices.Sort(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// Requested lifetime for comparing, empty for the default lifetime
+func lifetimeToString(lifetime time.Duration) string {
+	if lifetime == 0 {
+		return ""
 	}
+	return lifetime.String()
 }
 
 func CertificateFromSecret(secret *corev1.Secret) (*Certificate, error) {
 	// Create a certificate from a Secret if is available
-	// Append content to New Certificate object
-	cert := &Certificate{
-		name: secret.Name,
-		key:  secret.Data[SECRET_KEY_KEY],
-		cert: secret.Data[SECRET_KEY_CERT],
+	cert, err := CertificateFromPEM(secret.Name, secret.Data[SECRET_KEY_CERT], secret.Data[SECRET_KEY_KEY])
+	if err != nil {
+		return nil, err
 	}
-	// Decode the needed information and add it to the object
-	pemPrivkey, _ := pem.Decode(cert.key)
-	if pemPrivkey.Type == TYPE_PRIV_KEY {
-		var err error
-		// Pem Private key for reissuing
-		cert.PrivateKey, err = x509.ParseECPrivateKey(pemPrivkey.Bytes)
+	cert.groups = secret.Annotations[ANNOTATION_GROUPS]
+	if lifetime, ok := secret.Annotations[ANNOTATION_LIFETIME]; ok && len(lifetime) > 0 {
+		cert.lifetime, err = time.ParseDuration(lifetime)
 		if err != nil {
 			return nil, err
 		}
-		cert.UpdateLastUsed()
-		return cert, nil
-	} else {
-		return nil, fmt.Errorf("wrong keytype from secret : %v", pemPrivkey.Type)
 	}
+	return cert, nil
 }
 
-// Full function for certificate creation
-func NewCertificate(client *KubeClient, name string) (*Certificate, error) {
-	cert := &Certificate{name: name}
-	err := cert.createEllipticKey()
-	if err != nil {
-		return nil, err
+func CertificateFromPEM(name string, certPEM []byte, keyPEM []byte) (*Certificate, error) {
+	// Append content to New Certificate object
+	cert := &Certificate{
+		name: name,
+		key:  keyPEM,
+		cert: certPEM,
 	}
-	csrbytes, err := cert.createEllipticCSR(name)
+	// Decode the needed information and add it to the object
+	var err error
+	// Pem Private key for reissuing
+	cert.PrivateKey, err = decodePrivateKey(cert.key)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("private key of %v: %w", name, err)
 	}
-	_, err = client.CreateCSR(name, csrbytes)
+	cert.UpdateLastUsed()
+	return cert, nil
+}
+
+// Full function for certificate creation
+// A lifetime of 0 uses the default expiration of the client
+func NewCertificate(client *KubeClient, name string, commonName string, groups []string, lifetime time.Duration) (*Certificate, error) {
+	cert := &Certificate{name: name, commonName: commonName, groups: groupsToString(groups), lifetime: lifetime}
+	err := cert.createKey(client.keyConfig)
 	if err != nil {
 		return nil, err
 	}
-	err = client.ApproveCSR(name)
-	if err != nil {
-		return nil, err
+	return cert.issue(client, groups, lifetime, false)
+}
+
+// Continue with the key of a certificate that was waiting for external approval, so a late approval is not lost
+func resumeCertificate(client *KubeClient, secret *corev1.Secret, name string, commonName string, groups []string, lifetime time.Duration) (*Certificate, error) {
+	key, err := decodePrivateKey(secret.Data[SECRET_KEY_KEY])
+	if err != nil || secret.Annotations[ANNOTATION_GROUPS] != groupsToString(groups) ||
+		secret.Annotations[ANNOTATION_COMMON_NAME] != commonName || secret.Annotations[ANNOTATION_LIFETIME] != lifetimeToString(lifetime) ||
+		!client.keyConfig.matches(key) {
+		log.Printf("Pending certificate for user %v no longer matches, creating new certificate\n", name)
+		client.DeleteSecret(name)
+		client.DeleteCSR(name)
+		return NewCertificate(client, name, commonName, groups, lifetime)
 	}
-	cert.cert, err = client.GetSignedCertificate(name)
+	log.Printf("Pending certificate for user %v, checking approval\n", name)
+	cert := &Certificate{PrivateKey: key, key: secret.Data[SECRET_KEY_KEY], name: name, commonName: commonName, groups: groupsToString(groups), lifetime: lifetime}
+	return cert.issue(client, groups, lifetime, true)
+}
+
+// Sign the key of cert and store it. If the CSR is still waiting for approval the key is kept in a pending Secret.
+func (cert *Certificate) issue(client *KubeClient, groups []string, lifetime time.Duration, pending bool) (*Certificate, error) {
+	csrbytes, err := cert.createCSR(cert.commonName, groups...)
 	if err != nil {
 		return nil, err
 	}
-	_, err = client.CreateSecret(name, cert.makeSecret(name))
+	cert.cert, err = client.signer.Sign(cert.name, csrbytes, lifetime)
+	var csrError *CSRError
+	if errors.As(err, &csrError) {
+		if csrError.Pending && !pending {
+			_, storeErr := client.CreateSecret(cert.name, cert.makePendingSecret())
+			if storeErr != nil {
+				log.Printf("Warning: Issue storing pending key: %+v", storeErr)
+			}
+		}
+		if csrError.Denied && pending {
+			client.DeleteSecret(cert.name)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	err = client.DeleteCSR(name)
+	if pending {
+		client.DeleteSecret(cert.name)
+	}
+	_, err = client.CreateSecret(cert.name, cert.makeSecret(cert.name))
 	if err != nil {
-		log.Printf("Warning: Issue deleting CSR: %+v", err)
+		return nil, err
 	}
 	cert.UpdateLastUsed()
 	return cert, err
@@ -145,6 +256,14 @@ func (cert *Certificate) UpdateLastUsed() {
 	cert.lastUsed = time.Now()
 }
 
+func (cert *Certificate) HasGroups(groups []string) bool {
+	return cert.groups == groupsToString(groups)
+}
+
+func (cert *Certificate) HasLifetime(lifetime time.Duration) bool {
+	return cert.lifetime == lifetime
+}
+
 func (cert *Certificate) Stale() bool {
 	return cert.lastUsed.Add(time.Minute * 30).Before(time.Now())
 }
@@ -177,28 +296,109 @@ func (cert *Certificate) makeSecret(name string) *corev1.Secret {
 				LABLE_VERSION:    genereateHash(data),
 				LABLE_EXPIRATION: expiration,
 			},
+			Annotations: map[string]string{
+				ANNOTATION_GROUPS:      cert.groups,
+				ANNOTATION_COMMON_NAME: cert.commonName,
+				ANNOTATION_LIFETIME:    lifetimeToString(cert.lifetime),
+			},
 		},
 		Data: data,
 	}
 }
 
+func (cert *Certificate) makePendingSecret() *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   cert.name,
+			Labels: map[string]string{LABLE_KEY: LABLE_KEY_PENDING},
+			Annotations: map[string]string{
+				ANNOTATION_GROUPS:      cert.groups,
+				ANNOTATION_COMMON_NAME: cert.commonName,
+				ANNOTATION_LIFETIME:    lifetimeToString(cert.lifetime),
+			},
+		},
+		Data: map[string][]byte{SECRET_KEY_KEY: cert.key},
+	}
+}
+
 func (cert *Certificate) createEllipticKey() error {
-	var err error
 	// Generate an elipticcurve private key using Prime256
-	cert.PrivateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return cert.createKey(KeyConfig{})
+}
+
+func (cert *Certificate) createKey(config KeyConfig) error {
+	var err error
+	cert.PrivateKey, err = config.generate()
 	if err != nil {
 		return err
 	}
-	// Convert Privatekey to DER
-	privkey, err := x509.MarshalECPrivateKey(cert.PrivateKey)
-	// Convert DER to PEM
-	cert.key = pem.EncodeToMemory(&pem.Block{Type: TYPE_PRIV_KEY, Bytes: privkey})
+	// Convert Privatekey to PKCS#8 PEM
+	cert.key, err = encodePrivateKey(cert.PrivateKey)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (cert *Certificate) createSelfSignedCA(name string, validity time.Duration) error {
+	// Create a CA certificate signed by its own key
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(time.Hour * -1),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return cert.signCertificate(template, cert)
+}
+
+func (cert *Certificate) createServingCert(ca *Certificate, hosts []string, validity time.Duration) error {
+	// Create a server certificate for the given hostnames and IPs signed by ca
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(time.Hour * -1),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return cert.signCertificate(template, ca)
+}
+
+func (cert *Certificate) signCertificate(template *x509.Certificate, ca *Certificate) error {
+	// Sign template for the key in cert with the key of ca
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template.SerialNumber = serialNumber
+	parent := template
+	if ca != cert {
+		parent, err = ca.getCertificate()
+		if err != nil {
+			return err
+		}
+	}
+	signedCertificate, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey(cert.PrivateKey), ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	// Convert DER to PEM
+	cert.cert = pem.EncodeToMemory(&pem.Block{
+		Type: TYPE_CERTIFICATE, Bytes: signedCertificate,
+	})
+	cert.Certificate = nil
+	return nil
+}
+
 // --- Testing Only ---
 func publicKey(priv interface{}) interface{} {
 	// Still don't understand why this would be needed.
@@ -207,8 +407,9 @@ func publicKey(priv interface{}) interface{} {
 	case *rsa.PrivateKey:
 		return &k.PublicKey
 	case *ecdsa.PrivateKey:
-		// Only this part should ever be used
 		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
 	default:
 		return nil
 	}
@@ -257,7 +458,7 @@ func (cert *Certificate) GetPEMKey() string {
 
 // --- End Testing Only ---
 
-func (cert *Certificate) createEllipticCSR(user string, groups ...string) ([]byte, error) {
+func (cert *Certificate) createCSR(user string, groups ...string) ([]byte, error) {
 	// Create a Certificate Signing request for signing in the KubeAPIServer
 	subject := new(pkix.Name)
 	// Create subject for User and groups as \CN and \O.
@@ -307,11 +508,12 @@ func (cert *Certificate) getCertificateNotAfterTime() (*time.Time, error) {
 }
 func (cert *Certificate) IsAboutToExpire() bool {
 	// Find is a certificate about to expire based on threshold
-	expiration, err := cert.getCertificateNotAfterTime()
+	certificate, err := cert.getCertificate()
 	if err != nil {
 		return true
 	}
-	return time.Now().Add(CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD).After(*expiration)
+	threshold := expirationThreshold(certificate.NotAfter.Sub(certificate.NotBefore))
+	return time.Now().Add(threshold).After(certificate.NotAfter)
 }
 
 // Some Helper Time to String and String to Time functions
@@ -1,9 +1,23 @@
 package main
 
 import (
+	"crypto/x509"
 	"testing"
+	"time"
 )
 
+// Self-signed CA valid for an hour
+func testCA(t *testing.T, name string) *Certificate {
+	ca := &Certificate{}
+	if err := ca.createEllipticKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.createSelfSignedCA(name, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
 func Test_Certificate(t *testing.T) {
 	cert := &Certificate{}
 	t.Run("Generate Key", func(t *testing.T) {
@@ -29,4 +43,102 @@ func Test_Certificate(t *testing.T) {
 		}
 		t.Log(timeToString(expiration))
 	})
+	t.Run("Lifetime Stored In Secret", func(t *testing.T) {
+		for _, lifetime := range []time.Duration{0, time.Hour * 8} {
+			cert.lifetime = lifetime
+			read, err := CertificateFromSecret(cert.makeSecret("test"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !read.HasLifetime(lifetime) || read.HasLifetime(time.Minute*30) {
+				t.Errorf("Error: lifetime %v read as %v", lifetime, read.lifetime)
+			}
+		}
+	})
+}
+
+func Test_CertificateLifetime(t *testing.T) {
+	ca := testCA(t, "test-client-ca")
+	signer, err := newLocalCASigner(SignerConfig{CACertificate: ca.GetPEMCert(), CAKey: ca.GetPEMKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Threshold", func(t *testing.T) {
+		for lifetime, expected := range map[time.Duration]time.Duration{
+			0:                CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD,
+			time.Minute * 10: time.Minute * 10 / 3,
+			time.Minute * 30: time.Minute * 10,
+			time.Hour * 8:    CERTIFICATE_ABOUTTOEXPIRE_THRESHOLD,
+		} {
+			if threshold := expirationThreshold(lifetime); threshold != expected {
+				t.Errorf("Error: threshold for %v %v != %v", lifetime, threshold, expected)
+			}
+		}
+	})
+	t.Run("Short Lifetime Not Reissued", func(t *testing.T) {
+		// A 30m certificate must be usable and not renewed on every request
+		cert := &Certificate{groups: "developers", commonName: "alice", lifetime: time.Minute * 30}
+		if err := cert.createEllipticKey(); err != nil {
+			t.Fatal(err)
+		}
+		csr, err := cert.createCSR("alice", "developers")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert.cert, err = signer.Sign("alice", csr, cert.lifetime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.IsAboutToExpire() {
+			t.Errorf("Error: new 30m certificate about to expire")
+		}
+		if secretAboutToExpire(cert.makeSecret("alice"), cert.lifetime) {
+			t.Errorf("Error: new 30m certificate Secret about to expire")
+		}
+		secret := cert.makeSecret("alice")
+		soon := time.Now().Add(time.Minute * 5)
+		secret.Labels[LABLE_EXPIRATION] = timeToString(&soon)
+		if !secretAboutToExpire(secret, cert.lifetime) {
+			t.Errorf("Error: Secret 5m before expiration not renewed")
+		}
+	})
+}
+
+func Test_ServingCertificate(t *testing.T) {
+	ca := &Certificate{}
+	serving := &Certificate{}
+	t.Run("Generate CA", func(t *testing.T) {
+		if err := ca.createEllipticKey(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ca.createSelfSignedCA("test-ca", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Generate Serving Certificate", func(t *testing.T) {
+		if err := serving.createEllipticKey(); err != nil {
+			t.Fatal(err)
+		}
+		if err := serving.createServingCert(ca, []string{"proxy.example.com", "127.0.0.1"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("Verify Chain", func(t *testing.T) {
+		caCert, err := ca.getCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servingCert, err := serving.getCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		for _, host := range []string{"proxy.example.com", "127.0.0.1"} {
+			_, err = servingCert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+			if err != nil {
+				t.Errorf("Error: %v not valid: %s", host, err.Error())
+			}
+		}
+	})
 }
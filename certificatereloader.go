@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Good documentation:
+// https://pkg.go.dev/crypto/tls#Config.GetCertificate
+// https://cert-manager.io/docs/usage/certificate/
+
+// A certificate and key pair read from disk that can be swapped while serving
+type ServingCertificate struct {
+	certFile    string
+	keyFile     string
+	caFile      string
+	hosts       []string
+	fingerprint [sha256.Size]byte
+	certificate atomic.Pointer[tls.Certificate]
+}
+
+// Keeps the serving certificates for the proxy up to date with the files on disk
+type CertificateReloader struct {
+	defaultCertificate *ServingCertificate
+	sniCertificates    []*ServingCertificate
+	interval           time.Duration
+}
+
+const (
+	CERTIFICATE_RELOAD_INTERVAL = time.Minute
+)
+
+func NewServingCertificate(certFile string, keyFile string, caFile string, hosts []string) (*ServingCertificate, error) {
+	sc := &ServingCertificate{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	for _, host := range hosts {
+		sc.hosts = append(sc.hosts, strings.ToLower(host))
+	}
+	_, err := sc.reload()
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *ServingCertificate) reload() (bool, error) {
+	// Read the files and only replace the certificate if the content has changed
+	certPEM, err := os.ReadFile(sc.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := os.ReadFile(sc.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var caPEM []byte
+	if len(sc.caFile) > 0 {
+		caPEM, err = os.ReadFile(sc.caFile)
+		if err != nil {
+			return false, err
+		}
+	}
+	fingerprint := sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM, caPEM}, nil))
+	if sc.certificate.Load() != nil && fingerprint == sc.fingerprint {
+		return false, nil
+	}
+	// The CA bundle is appended so the full chain is presented to clients
+	if len(caPEM) > 0 {
+		certPEM = append(append(bytes.TrimSpace(certPEM), '\n'), caPEM...)
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	sc.fingerprint = fingerprint
+	sc.certificate.Store(&certificate)
+	return true, nil
+}
+
+func (sc *ServingCertificate) matches(serverName string) bool {
+	// Exact match or a single label wildcard like *.example.com
+	for _, host := range sc.hosts {
+		if host == serverName {
+			return true
+		}
+		if strings.HasPrefix(host, "*.") {
+			label, rest, found := strings.Cut(serverName, ".")
+			if found && len(label) > 0 && "*."+rest == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func NewCertificateReloader(config TLSConfig) (*CertificateReloader, error) {
+	cr := &CertificateReloader{interval: config.ReloadInterval}
+	if cr.interval <= 0 {
+		cr.interval = CERTIFICATE_RELOAD_INTERVAL
+	}
+	if len(config.Certificate) > 0 && len(config.Key) > 0 {
+		sc, err := NewServingCertificate(config.Certificate, config.Key, config.CACertificate, nil)
+		if err != nil {
+			return nil, err
+		}
+		cr.defaultCertificate = sc
+	}
+	for _, sni := range config.SNI {
+		sc, err := NewServingCertificate(sni.Certificate, sni.Key, sni.CACertificate, sni.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		cr.sniCertificates = append(cr.sniCertificates, sc)
+	}
+	if cr.defaultCertificate == nil && len(cr.sniCertificates) == 0 {
+		return nil, errors.New("no serving certificates configured")
+	}
+	go cr.reloadTask()
+	return cr, nil
+}
+
+// tls.Config GetCertificate callback selecting the certificate based on SNI
+func (cr *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if len(serverName) > 0 {
+		for _, sc := range cr.sniCertificates {
+			if sc.matches(serverName) {
+				return sc.certificate.Load(), nil
+			}
+		}
+	}
+	if cr.defaultCertificate != nil {
+		return cr.defaultCertificate.certificate.Load(), nil
+	}
+	return cr.sniCertificates[0].certificate.Load(), nil
+}
+
+func (cr *CertificateReloader) all() []*ServingCertificate {
+	certificates := cr.sniCertificates
+	if cr.defaultCertificate != nil {
+		certificates = append([]*ServingCertificate{cr.defaultCertificate}, certificates...)
+	}
+	return certificates
+}
+
+func (cr *CertificateReloader) reloadTask() {
+	ticker := time.NewTicker(cr.interval)
+	for range ticker.C {
+		for _, sc := range cr.all() {
+			changed, err := sc.reload()
+			if err != nil {
+				// Keep serving the previous certificate, files can be mid rotation
+				log.Printf("@E Error reloading certificate %v: %+v\n", sc.certFile, err)
+				continue
+			}
+			if changed {
+				log.Printf("@I Reloaded certificate %v (expires %v)\n", sc.certFile, sc.certificate.Load().Leaf.NotAfter)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKeyPair(t *testing.T, dir string, name string) (string, string) {
+	cert := &Certificate{}
+	err := cert.createEllipticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cert.testCreateEllipticCert(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, cert.cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, cert.key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_CertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeTestKeyPair(t, dir, "default")
+	sniCert, sniKey := writeTestKeyPair(t, dir, "sni")
+	reloader, err := NewCertificateReloader(TLSConfig{
+		Certificate: defaultCert,
+		Key:         defaultKey,
+		SNI: []SNICertificateConfig{
+			{Hosts: []string{"kube.example.com", "*.apps.example.com"}, Certificate: sniCert, Key: sniKey},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	getCommonName := func(serverName string) string {
+		certificate, err := reloader.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate.Leaf.Subject.CommonName
+	}
+	t.Run("SNI Selection", func(t *testing.T) {
+		for serverName, expected := range map[string]string{
+			"":                     "default",
+			"other.example.com":    "default",
+			"KUBE.example.com":     "sni",
+			"x.apps.example.com":   "sni",
+			"x.y.apps.example.com": "default",
+		} {
+			if cn := getCommonName(serverName); cn != expected {
+				t.Errorf("Error: %q served %v, expected %v", serverName, cn, expected)
+			}
+		}
+	})
+	t.Run("Reload Changed Files", func(t *testing.T) {
+		renewedCert, renewedKey := writeTestKeyPair(t, dir, "renewed")
+		os.Rename(renewedCert, defaultCert)
+		os.Rename(renewedKey, defaultKey)
+		changed, err := reloader.defaultCertificate.reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !changed {
+			t.Error("Error: changed files not detected")
+		}
+		if cn := getCommonName(""); cn != "renewed" {
+			t.Errorf("Error: served %v after reload, expected renewed", cn)
+		}
+		changed, _ = reloader.defaultCertificate.reload()
+		if changed {
+			t.Error("Error: unchanged files reloaded")
+		}
+	})
+}
@@ -17,13 +17,18 @@ func NewCertificateStorage(client *KubeClient) *CertificateStorage {
 	return cs
 }
 
-func (CS *CertificateStorage) GetCertificate(name string) (*Certificate, error) {
+// Certificates are stored by name and issued for commonName
+func (CS *CertificateStorage) GetCertificate(name string, commonName string, groups []string, lifetime time.Duration) (*Certificate, error) {
 	cert, ok := CS.storage.Load(name)
 	if ok {
 		certOfType, ok := cert.(*Certificate)
 		if ok {
 			if certOfType.IsAboutToExpire() {
 				log.Println("Cached certificate is about to expire renewing")
+			} else if !certOfType.HasGroups(groups) || certOfType.commonName != commonName {
+				log.Println("Cached certificate groups changed renewing")
+			} else if !certOfType.HasLifetime(lifetime) {
+				log.Println("Cached certificate lifetime changed renewing")
 			} else {
 				certOfType.UpdateLastUsed()
 				log.Println("Using cached certificate")
@@ -35,7 +40,7 @@ func (CS *CertificateStorage) GetCertificate(name string) (*Certificate, error)
 	} else {
 		log.Printf("Unable to read certificate for user: %v", name)
 	}
-	certOfType, err := NewClientAuth(CS.client, name)
+	certOfType, err := NewClientAuth(CS.client, name, commonName, groups, lifetime)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Good documentation:
+// https://venilnoronha.io/a-step-by-step-guide-to-mtls-in-go
+// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#x509-client-certificates
+
+// Authenticates users by a client certificate verified by the TLS listener
+type ClientCertificateAuth struct {
+	LDAPAuth         *LDAPAuth
+	RequireLDAPGroup bool
+	caCertPool       *x509.CertPool
+	// LDAPAuth.TestMember, replaceable in tests
+	testMember func(Username string) (*LDAPUser, error)
+}
+
+func NewClientCertificateAuth(config ClientAuthConfig, ldapAuth *LDAPAuth) (*ClientCertificateAuth, error) {
+	caCert, err := os.ReadFile(config.CA)
+	if err != nil {
+		return nil, err
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no certificates found in client CA %v", config.CA)
+	}
+	return &ClientCertificateAuth{LDAPAuth: ldapAuth, RequireLDAPGroup: config.RequireLDAPGroup, caCertPool: caCertPool, testMember: ldapAuth.TestMember}, nil
+}
+
+// True if the request came with a certificate verified against the client CA
+func hasClientCertificate(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0
+}
+
+// Get the identity from a verified client certificate, CN is the user and O the groups.
+// Returns nil if the user is rejected.
+func (cca *ClientCertificateAuth) Authenticate(r *http.Request) (*LDAPUser, error) {
+	if !hasClientCertificate(r) {
+		return nil, errors.New("no verified client certificate")
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if len(subject.CommonName) == 0 {
+		log.Printf("@I Client certificate without CN rejected (serial %v)\n", r.TLS.VerifiedChains[0][0].SerialNumber)
+		return nil, nil
+	}
+	user := &LDAPUser{User: subject.CommonName, LDAPGroups: subject.Organization}
+	if cca.RequireLDAPGroup {
+		member, err := cca.testMember(user.User)
+		if err != nil {
+			return nil, err
+		}
+		if member == nil {
+			log.Printf("@I Client certificate user %v is not a member of any access group\n", user.User)
+			return nil, nil
+		}
+		user.AccessGroups = member.AccessGroups
+		user.UID = member.UID
+		user.Extra = member.Extra
+	}
+	return user, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createClientCert(t *testing.T, ca *Certificate, commonName string, groups []string, notAfter time.Time) tls.Certificate {
+	cert := &Certificate{}
+	if err := cert.createEllipticKey(); err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName, Organization: groups},
+		NotBefore:   notAfter.Add(time.Hour * -2),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if err := cert.signCertificate(template, ca); err != nil {
+		t.Fatal(err)
+	}
+	tlsCert, err := cert.GetTLSCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tlsCert
+}
+
+func Test_ClientCertificateAuth(t *testing.T) {
+	ca := testCA(t, "test-client-ca")
+	unknownCA := testCA(t, "test-unknown-ca")
+	serving := &Certificate{}
+	if err := serving.createEllipticKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := serving.createServingCert(ca, []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	servingCert, err := serving.GetTLSCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	if err := os.WriteFile(caFile, ca.cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cca, err := NewClientCertificateAuth(ClientAuthConfig{CA: caFile}, &LDAPAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := map[string]*LDAPUser{
+		"alice": {User: "alice", UID: "1001", AccessGroups: []string{"kube-admins"}},
+	}
+	cca.testMember = func(Username string) (*LDAPUser, error) {
+		if Username == "ldap-down" {
+			return nil, errors.New("LDAP Result Code 200 \"Network Error\"")
+		}
+		return members[Username], nil
+	}
+	// Same listener settings as the proxy
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := cca.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%v %v %v %v", user.User, strings.Join(slices.Sorted(slices.Values(user.LDAPGroups)), ","), user.UID, strings.Join(user.AccessGroups, ","))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{servingCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    cca.caCertPool,
+	}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	caCert, _ := ca.getCertificate()
+	roots.AddCert(caCert)
+	valid := time.Now().Add(time.Hour)
+	for _, test := range []struct {
+		name             string
+		cert             tls.Certificate
+		requireLDAPGroup bool
+		code             int
+		body             string
+	}{
+		{"Authenticate", createClientCert(t, ca, "alice", []string{"developers", "sre"}, valid), false, http.StatusOK, "alice developers,sre  "},
+		{"No Certificate", tls.Certificate{}, false, http.StatusInternalServerError, "no verified client certificate"},
+		{"No Common Name", createClientCert(t, ca, "", []string{"developers"}, valid), false, http.StatusForbidden, ""},
+		{"Require LDAP Group", createClientCert(t, ca, "alice", []string{"developers"}, valid), true, http.StatusOK, "alice developers 1001 kube-admins"},
+		{"Not In LDAP Group", createClientCert(t, ca, "bob", []string{"developers"}, valid), true, http.StatusForbidden, ""},
+		{"LDAP Error", createClientCert(t, ca, "ldap-down", nil, valid), true, http.StatusInternalServerError, "Network Error"},
+		{"Unknown CA", createClientCert(t, unknownCA, "alice", []string{"developers"}, valid), false, 0, ""},
+		{"Expired", createClientCert(t, ca, "alice", []string{"developers"}, time.Now().Add(time.Minute*-1)), false, 0, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cca.RequireLDAPGroup = test.requireLDAPGroup
+			tlsConfig := &tls.Config{RootCAs: roots}
+			if len(test.cert.Certificate) > 0 {
+				// Sent even if the server does not list its issuer
+				tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &test.cert, nil
+				}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			response, err := client.Get(server.URL)
+			// Certificates not verified by the client CA are rejected in the handshake
+			if test.code == 0 {
+				if err == nil {
+					response.Body.Close()
+					t.Errorf("Error: certificate accepted with %v", response.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			if response.StatusCode != test.code || !strings.Contains(string(body), test.body) {
+				t.Errorf("Error: %v %q != %v %q", response.StatusCode, body, test.code, test.body)
+			}
+		})
+	}
+}
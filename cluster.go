@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Requests to /clusters/<name>/... are sent to the cluster <name>
+const CLUSTER_PATH_PREFIX = "/clusters/"
+
+// One upstream Kubernetes cluster with its own credentials and certificates
+type Cluster struct {
+	ClusterConfig
+	KubeClient        *KubeClient
+	certificaeStorage *CertificateStorage
+	serviceAccounts   *ServiceAccountStorage
+	endpoints         *Endpoints
+}
+
+// Clusters from configuration. Without Clusters, Kubernetes is used as the only cluster.
+func NewClusters(config *MainConfig, client *KubeClient) ([]*Cluster, error) {
+	if err := validateMode(config.Mode); err != nil {
+		return nil, err
+	}
+	if len(config.Clusters) == 0 {
+		cluster := &Cluster{ClusterConfig: ClusterConfig{KubernetesConfig: config.Kubernetes}, KubeClient: client}
+		if config.usesMode(cluster.Mode, MODE_CERTIFICATE) {
+			cluster.certificaeStorage = NewCertificateStorage(client)
+		}
+		if config.usesMode(cluster.Mode, MODE_SERVICEACCOUNT) {
+			cluster.serviceAccounts = NewServiceAccountStorage(client, cluster.ServiceAccounts)
+		}
+		if err := cluster.checkFrontProxy(config); err != nil {
+			return nil, err
+		}
+		cluster.endpoints = client.endpoints
+		return []*Cluster{cluster}, nil
+	}
+	var clusters []*Cluster
+	for _, clusterConfig := range config.Clusters {
+		if len(clusterConfig.Name) == 0 {
+			return nil, fmt.Errorf("cluster without name")
+		}
+		if len(clusterConfig.Namespace) == 0 {
+			clusterConfig.Namespace = config.Kubernetes.Namespace
+		}
+		if err := validateMode(clusterConfig.Mode); err != nil {
+			return nil, fmt.Errorf("cluster %v: %w", clusterConfig.Name, err)
+		}
+		clusterClient, err := NewKubeClient(clusterConfig.KubernetesConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %v: %w", clusterConfig.Name, err)
+		}
+		cluster := &Cluster{ClusterConfig: clusterConfig, KubeClient: clusterClient}
+		if config.usesMode(cluster.Mode, MODE_CERTIFICATE) {
+			cluster.certificaeStorage = NewCertificateStorage(clusterClient)
+		}
+		if config.usesMode(cluster.Mode, MODE_SERVICEACCOUNT) {
+			cluster.serviceAccounts = NewServiceAccountStorage(clusterClient, cluster.ServiceAccounts)
+		}
+		if err := cluster.checkFrontProxy(config); err != nil {
+			return nil, fmt.Errorf("cluster %v: %w", clusterConfig.Name, err)
+		}
+		cluster.endpoints = clusterClient.endpoints
+		log.Printf("@I Cluster %v on %v\n", cluster.Name, clusterClient.servers(cluster.KubernetesConfig))
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// Find the cluster by path prefix or hostname. The path prefix is removed from the request.
+// Returns nil if no cluster matches and there is more than one to choose from.
+func (proxy *Proxy) selectCluster(r *http.Request) *Cluster {
+	if rest, found := strings.CutPrefix(r.URL.Path, CLUSTER_PATH_PREFIX); found {
+		name, path, _ := strings.Cut(rest, "/")
+		for _, cluster := range proxy.clusters {
+			if len(cluster.Name) > 0 && cluster.Name == name {
+				r.URL.Path = "/" + path
+				r.URL.RawPath = ""
+				r.RequestURI = r.URL.RequestURI()
+				return cluster
+			}
+		}
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = hostname
+	}
+	for _, cluster := range proxy.clusters {
+		if slices.ContainsFunc(cluster.Hostnames, func(hostname string) bool {
+			return strings.EqualFold(hostname, host)
+		}) {
+			return cluster
+		}
+	}
+	if len(proxy.clusters) == 1 {
+		return proxy.clusters[0]
+	}
+	return nil
+}
+
+// Users must be a member of one of AllowedGroups if any are set
+func (cluster *Cluster) allows(user *LDAPUser) bool {
+	if len(cluster.AllowedGroups) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(cluster.AllowedGroups, func(group string) bool {
+		return slices.Contains(user.LDAPGroups, group) || slices.Contains(user.AccessGroups, group)
+	})
+}
+
+// Front-proxy mode can not work without the front-proxy client certificate
+func (cluster *Cluster) checkFrontProxy(config *MainConfig) error {
+	if config.usesMode(cluster.Mode, MODE_FRONTPROXY) && cluster.KubeClient.frontProxyTransport == nil {
+		return fmt.Errorf("front-proxy mode requires FrontProxy.Certificate and FrontProxy.Key")
+	}
+	return nil
+}
+
+// Keep the ServiceAccounts of every cluster in serviceaccount mode in line with LDAP
+func (proxy *Proxy) startServiceAccountSync() {
+	for _, cluster := range proxy.clusters {
+		if cluster.serviceAccounts != nil {
+			go cluster.serviceAccounts.syncTask(proxy.refreshGroups)
+		}
+	}
+}
+
+// Current Kubernetes groups of a user from LDAP, ok false if the user is no longer in an access group
+func (proxy *Proxy) refreshGroups(username string) ([]string, bool, error) {
+	user, err := proxy.LDAPAuth.TestMember(username)
+	if err != nil || user == nil {
+		return nil, false, err
+	}
+	return proxy.kubernetesGroups(user), true, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_Cluster(t *testing.T) {
+	prod := &Cluster{ClusterConfig: ClusterConfig{Name: "prod", Hostnames: []string{"prod.kube.example.com"}, AllowedGroups: []string{"sre"}}}
+	dev := &Cluster{ClusterConfig: ClusterConfig{Name: "dev"}}
+	proxy := &Proxy{clusters: []*Cluster{prod, dev}}
+	t.Run("Select", func(t *testing.T) {
+		for _, test := range []struct {
+			host       string
+			requestURI string
+			cluster    *Cluster
+			path       string
+		}{
+			{"kube.example.com", "/clusters/dev/api/v1/pods?watch=1", dev, "/api/v1/pods?watch=1"},
+			{"prod.kube.example.com:443", "/api/v1/pods", prod, "/api/v1/pods"},
+			{"PROD.kube.example.com", "/clusters/dev/api", dev, "/api"},
+			{"kube.example.com", "/clusters/test/api", nil, ""},
+			{"kube.example.com", "/api", nil, ""},
+		} {
+			request, err := http.NewRequest(http.MethodGet, "https://"+test.host+test.requestURI, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RequestURI = test.requestURI
+			cluster := proxy.selectCluster(request)
+			if cluster != test.cluster {
+				t.Errorf("Error: %v%v selected %v", test.host, test.requestURI, cluster)
+				continue
+			}
+			if cluster != nil && request.RequestURI != test.path {
+				t.Errorf("Error: %v != %v", request.RequestURI, test.path)
+			}
+		}
+	})
+	t.Run("Single Cluster Default", func(t *testing.T) {
+		single := &Proxy{clusters: []*Cluster{dev}}
+		request, _ := http.NewRequest(http.MethodGet, "https://kube.example.com/api", nil)
+		if cluster := single.selectCluster(request); cluster != dev {
+			t.Errorf("Error: %v selected", cluster)
+		}
+	})
+	t.Run("Allowed Groups", func(t *testing.T) {
+		if !prod.allows(&LDAPUser{User: "alice", LDAPGroups: []string{"sre"}}) {
+			t.Errorf("Error: sre not allowed on prod")
+		}
+		if prod.allows(&LDAPUser{User: "bob", LDAPGroups: []string{"developers"}}) {
+			t.Errorf("Error: developers allowed on prod")
+		}
+		if !dev.allows(&LDAPUser{User: "bob"}) {
+			t.Errorf("Error: bob not allowed on dev")
+		}
+	})
+}
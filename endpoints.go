@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/using-api/health-checks/
+
+const (
+	BALANCING_ROUND_ROBIN = "roundrobin"
+	BALANCING_LEAST_CONN  = "leastconn"
+	HEALTH_CHECK_PATH     = "/readyz"
+	HEALTH_CHECK_INTERVAL = 10 * time.Second
+	HEALTH_CHECK_TIMEOUT  = 5 * time.Second
+)
+
+// Methods safe to send again to another API server
+var idempotentMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+type upstreamEndpoint struct {
+	server  string
+	healthy atomic.Bool
+	active  atomic.Int64
+}
+
+// API servers of one cluster
+type Endpoints struct {
+	endpoints []*upstreamEndpoint
+	balancing string
+	next      atomic.Uint64
+	client    *http.Client
+}
+
+func NewEndpoints(config KubernetesConfig, client *KubeClient) (*Endpoints, error) {
+	switch config.Balancing {
+	case "", BALANCING_ROUND_ROBIN, BALANCING_LEAST_CONN:
+	default:
+		return nil, fmt.Errorf("unknown balancing %v", config.Balancing)
+	}
+	endpoints := &Endpoints{balancing: config.Balancing, client: &http.Client{Transport: client.transport, Timeout: HEALTH_CHECK_TIMEOUT}}
+	for _, server := range client.servers(config) {
+		endpoint := &upstreamEndpoint{server: server}
+		endpoint.healthy.Store(true)
+		endpoints.endpoints = append(endpoints.endpoints, endpoint)
+	}
+	// A single API server is used no matter what, so there is nothing to check
+	if len(endpoints.endpoints) > 1 {
+		interval := config.HealthCheckInterval
+		if interval <= 0 {
+			interval = HEALTH_CHECK_INTERVAL
+		}
+		go endpoints.healthCheckTask(interval)
+	}
+	return endpoints, nil
+}
+
+// Healthy endpoint not in tried. Unhealthy ones are used if nothing else is left.
+func (endpoints *Endpoints) pick(tried []*upstreamEndpoint) *upstreamEndpoint {
+	var candidates []*upstreamEndpoint
+	for _, endpoint := range endpoints.endpoints {
+		if endpoint.healthy.Load() && !slices.Contains(tried, endpoint) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, endpoint := range endpoints.endpoints {
+			if !slices.Contains(tried, endpoint) {
+				candidates = append(candidates, endpoint)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if endpoints.balancing == BALANCING_LEAST_CONN {
+		least := candidates[0]
+		for _, endpoint := range candidates[1:] {
+			if endpoint.active.Load() < least.active.Load() {
+				least = endpoint
+			}
+		}
+		return least
+	}
+	return candidates[endpoints.next.Add(1)%uint64(len(candidates))]
+}
+
+func (endpoints *Endpoints) setHealthy(endpoint *upstreamEndpoint, healthy bool, reason string) {
+	if endpoint.healthy.Swap(healthy) != healthy {
+		if healthy {
+			log.Printf("@I API server %v is healthy\n", endpoint.server)
+		} else {
+			log.Printf("@E API server %v is unhealthy: %v\n", endpoint.server, reason)
+		}
+	}
+}
+
+func (endpoints *Endpoints) check(endpoint *upstreamEndpoint) {
+	response, err := endpoints.client.Get(endpoint.server + HEALTH_CHECK_PATH)
+	if err != nil {
+		endpoints.setHealthy(endpoint, false, err.Error())
+		return
+	}
+	response.Body.Close()
+	endpoints.setHealthy(endpoint, response.StatusCode == http.StatusOK, response.Status)
+}
+
+func (endpoints *Endpoints) healthCheckTask(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		for _, endpoint := range endpoints.endpoints {
+			endpoints.check(endpoint)
+		}
+	}
+}
+
+// Send a request to an endpoint, retrying idempotent requests that fail to connect on the next one.
+// newRequest is called for every attempt with the base URL of the API server to use.
+func (endpoints *Endpoints) Do(client *http.Client, method string, newRequest func(server string) (*http.Request, error)) (*http.Response, func(), error) {
+	var tried []*upstreamEndpoint
+	for {
+		endpoint := endpoints.pick(tried)
+		if endpoint == nil {
+			return nil, nil, fmt.Errorf("no API server left to try")
+		}
+		tried = append(tried, endpoint)
+		request, err := newRequest(endpoint.server)
+		if err != nil {
+			return nil, nil, err
+		}
+		endpoint.active.Add(1)
+		response, err := client.Do(request)
+		if err == nil {
+			return response, func() { endpoint.active.Add(-1) }, nil
+		}
+		endpoint.active.Add(-1)
+		if request.Context().Err() != nil {
+			// The client went away, that says nothing about the API server
+			return nil, nil, err
+		}
+		endpoints.setHealthy(endpoint, false, err.Error())
+		if !slices.Contains(idempotentMethods, method) || len(tried) == len(endpoints.endpoints) {
+			return nil, nil, err
+		}
+		log.Printf("@I Retrying %v %v on another API server after: %v\n", method, request.URL.Path, err)
+	}
+}
+
+// Sends the requests of the clientset through the endpoints, so CSRs, Secrets, tokens and the
+// throttle store do not depend on the one API server the clientset was built for (base).
+type endpointsTransport struct {
+	endpoints *Endpoints
+	base      string
+	client    *http.Client
+}
+
+func (transport *endpointsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base, err := url.Parse(transport.base)
+	if err != nil {
+		return nil, err
+	}
+	// Path below the base, API servers behind a gateway have their own path prefix
+	path := strings.TrimPrefix(r.URL.EscapedPath(), strings.TrimSuffix(base.EscapedPath(), "/"))
+	response, done, err := transport.endpoints.Do(transport.client, r.Method, func(server string) (*http.Request, error) {
+		target, err := url.Parse(server + path)
+		if err != nil {
+			return nil, err
+		}
+		target.RawQuery = r.URL.RawQuery
+		request := r.Clone(r.Context())
+		request.URL = target
+		request.Host = ""
+		return request, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Body = &doneReadCloser{ReadCloser: response.Body, done: done}
+	return response, nil
+}
+
+// Releases the endpoint when the response body is closed
+type doneReadCloser struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (body *doneReadCloser) Close() error {
+	body.once.Do(body.done)
+	return body.ReadCloser.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func Test_Endpoints(t *testing.T) {
+	healthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/gateway/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+	notReady := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusInternalServerError)
+	}))
+	defer notReady.Close()
+	stopped := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	stoppedHost := stopped.URL
+	stopped.Close()
+	// Servers behind a gateway have a path prefix
+	healthyHost := healthy.URL + "/gateway"
+	notReadyHost := notReady.URL
+	client := healthy.Client()
+	// Both test servers use the same certificate
+	newEndpoints := func(balancing string, hosts ...string) *Endpoints {
+		endpoints := &Endpoints{balancing: balancing, client: client}
+		for _, server := range hosts {
+			endpoint := &upstreamEndpoint{server: server}
+			endpoint.healthy.Store(true)
+			endpoints.endpoints = append(endpoints.endpoints, endpoint)
+		}
+		return endpoints
+	}
+	newRequest := func(method string) func(host string) (*http.Request, error) {
+		return func(server string) (*http.Request, error) {
+			return http.NewRequest(method, server+"/api", nil)
+		}
+	}
+	t.Run("Health Check", func(t *testing.T) {
+		endpoints := newEndpoints(BALANCING_ROUND_ROBIN, healthyHost, notReadyHost, stoppedHost)
+		for _, endpoint := range endpoints.endpoints {
+			endpoints.check(endpoint)
+		}
+		for i, expected := range []bool{true, false, false} {
+			if endpoints.endpoints[i].healthy.Load() != expected {
+				t.Errorf("Error: %v healthy != %v", endpoints.endpoints[i].server, expected)
+			}
+		}
+		for range 3 {
+			if endpoint := endpoints.pick(nil); endpoint != endpoints.endpoints[0] {
+				t.Errorf("Error: unhealthy %v picked", endpoint.server)
+			}
+		}
+	})
+	t.Run("Least Connections", func(t *testing.T) {
+		endpoints := newEndpoints(BALANCING_LEAST_CONN, "a", "b", "c")
+		endpoints.endpoints[0].active.Store(2)
+		endpoints.endpoints[1].active.Store(1)
+		endpoints.endpoints[2].active.Store(3)
+		if endpoint := endpoints.pick(nil); endpoint.server != "b" {
+			t.Errorf("Error: %v != b", endpoint.server)
+		}
+	})
+	t.Run("Retry Idempotent", func(t *testing.T) {
+		endpoints := newEndpoints(BALANCING_ROUND_ROBIN, stoppedHost, healthyHost)
+		// The next round robin pick is the stopped endpoint
+		endpoints.next.Store(1)
+		response, done, err := endpoints.Do(client, http.MethodGet, newRequest(http.MethodGet))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Error: %v from %v", response.Status, response.Request.URL)
+		}
+		if endpoints.endpoints[0].healthy.Load() {
+			t.Errorf("Error: stopped endpoint still healthy")
+		}
+		if endpoints.endpoints[1].active.Load() != 0 {
+			t.Errorf("Error: active connections not released")
+		}
+	})
+	t.Run("No Retry For Post", func(t *testing.T) {
+		endpoints := newEndpoints(BALANCING_ROUND_ROBIN, stoppedHost, healthyHost)
+		endpoints.next.Store(1)
+		if _, _, err := endpoints.Do(client, http.MethodPost, newRequest(http.MethodPost)); err == nil {
+			t.Errorf("Error: POST retried")
+		}
+	})
+	t.Run("Clientset Failover", func(t *testing.T) {
+		endpoints := newEndpoints(BALANCING_ROUND_ROBIN, stoppedHost, healthyHost)
+		endpoints.next.Store(1)
+		// The clientset is built for the healthy server behind the gateway, its path prefix is replaced per endpoint
+		kube := &KubeClient{config: &rest.Config{Host: healthyHost}, transport: client.Transport, endpoints: endpoints}
+		if err := kube.createClientset(); err != nil {
+			t.Fatal(err)
+		}
+		body, err := kube.clientset.Discovery().RESTClient().Get().AbsPath("/api").DoRaw(context.Background())
+		if err != nil || string(body) != "ok" {
+			t.Errorf("Error: %q %v", body, err)
+		}
+		if endpoints.endpoints[0].healthy.Load() {
+			t.Errorf("Error: stopped endpoint still healthy")
+		}
+		if endpoints.endpoints[1].active.Load() != 0 {
+			t.Errorf("Error: active connections not released")
+		}
+	})
+}
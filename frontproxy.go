@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/tasks/extend-kubernetes/configure-aggregation-layer/#kubernetes-apiserver-client-authentication
+// https://kubernetes.io/docs/reference/command-line-tools-reference/kube-apiserver/ (--requestheader-*)
+
+const (
+	FRONT_PROXY_USERNAME_HEADER     = "X-Remote-User"
+	FRONT_PROXY_GROUP_HEADER        = "X-Remote-Group"
+	FRONT_PROXY_UID_HEADER          = "X-Remote-Uid"
+	FRONT_PROXY_EXTRA_HEADER_PREFIX = "X-Remote-Extra-"
+)
+
+// Header names from configuration or the kube-apiserver defaults
+func (config FrontProxyConfig) withDefaults() FrontProxyConfig {
+	if len(config.UsernameHeader) == 0 {
+		config.UsernameHeader = FRONT_PROXY_USERNAME_HEADER
+	}
+	if len(config.GroupHeader) == 0 {
+		config.GroupHeader = FRONT_PROXY_GROUP_HEADER
+	}
+	if len(config.UIDHeader) == 0 {
+		config.UIDHeader = FRONT_PROXY_UID_HEADER
+	}
+	if len(config.ExtraHeaderPrefix) == 0 {
+		config.ExtraHeaderPrefix = FRONT_PROXY_EXTRA_HEADER_PREFIX
+	}
+	return config
+}
+
+// Transport presenting the front-proxy client certificate, left nil if none is configured
+func (kube *KubeClient) createFrontProxyTransport(config FrontProxyConfig) error {
+	if len(config.Certificate) == 0 && len(config.Key) == 0 {
+		return nil
+	}
+	certificate, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+	if err != nil {
+		return fmt.Errorf("front-proxy certificate: %w", err)
+	}
+	kube.frontProxyTransport = kube.userTransport(certificate)
+	return nil
+}
+
+// Remove client copies of the front-proxy headers and set the identity of user
+func setFrontProxyHeaders(header http.Header, config FrontProxyConfig, user *LDAPUser) {
+	config = config.withDefaults()
+	extraPrefix := strings.ToLower(config.ExtraHeaderPrefix)
+	for key := range header {
+		lower := strings.ToLower(key)
+		if lower == strings.ToLower(config.UsernameHeader) || lower == strings.ToLower(config.GroupHeader) ||
+			lower == strings.ToLower(config.UIDHeader) || strings.HasPrefix(lower, extraPrefix) {
+			delete(header, key)
+		}
+	}
+	header[http.CanonicalHeaderKey(config.UsernameHeader)] = []string{user.KubernetesUser}
+	if len(user.Groups) > 0 {
+		header[http.CanonicalHeaderKey(config.GroupHeader)] = user.Groups
+	}
+	if len(user.UID) > 0 {
+		header[http.CanonicalHeaderKey(config.UIDHeader)] = []string{user.UID}
+	}
+	for key, values := range user.Extra {
+		// Extra keys are case insensitive and percent encoded like Impersonate-Extra-
+		header[config.ExtraHeaderPrefix+url.PathEscape(strings.ToLower(key))] = values
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func Test_FrontProxy(t *testing.T) {
+	user := &LDAPUser{User: "alice", KubernetesUser: "ldap:alice", Groups: []string{"developers", "sre"}, UID: "1234", Extra: map[string][]string{"Email": {"alice@example.com"}}}
+	t.Run("Default Headers", func(t *testing.T) {
+		header := http.Header{
+			"Accept":                {"application/json"},
+			"X-Remote-User":         {"system:admin"},
+			"X-Remote-Group":        {"system:masters"},
+			"x-remote-extra-scopes": {"everything"},
+			"X-Remote-Extra-Reason": {"client"},
+		}
+		setFrontProxyHeaders(header, FrontProxyConfig{}, user)
+		expected := http.Header{
+			"Accept":               {"application/json"},
+			"X-Remote-User":        {"ldap:alice"},
+			"X-Remote-Group":       {"developers", "sre"},
+			"X-Remote-Uid":         {"1234"},
+			"X-Remote-Extra-email": {"alice@example.com"},
+		}
+		if len(header) != len(expected) {
+			t.Errorf("Error: %v != %v", header, expected)
+		}
+		for key, values := range expected {
+			if !slices.Equal(header[key], values) {
+				t.Errorf("Error: %v: %v != %v", key, header[key], values)
+			}
+		}
+	})
+	t.Run("Configured Headers", func(t *testing.T) {
+		header := http.Header{"X-Auth-User": {"system:admin"}}
+		setFrontProxyHeaders(header, FrontProxyConfig{UsernameHeader: "X-Auth-User", GroupHeader: "X-Auth-Group", ExtraHeaderPrefix: "X-Auth-Extra-"}, user)
+		if !slices.Equal(header["X-Auth-User"], []string{"ldap:alice"}) || !slices.Equal(header["X-Auth-Group"], user.Groups) {
+			t.Errorf("Error: %v", header)
+		}
+		if _, ok := header["X-Remote-User"]; ok {
+			t.Errorf("Error: default header used %v", header)
+		}
+	})
+	t.Run("Mode", func(t *testing.T) {
+		config := &MainConfig{Impersonation: true, Mode: MODE_FRONTPROXY}
+		if mode := config.defaultMode(""); mode != MODE_FRONTPROXY {
+			t.Errorf("Error: %v != %v", mode, MODE_FRONTPROXY)
+		}
+		cluster := &Cluster{KubeClient: &KubeClient{}}
+		if err := cluster.checkFrontProxy(config); err == nil {
+			t.Errorf("Error: front-proxy mode accepted without certificate")
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// Turns LDAP group names into the Kubernetes groups sent to the cluster
+type GroupMapping struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	rename  []groupRename
+	prefix  string
+	static  []StaticGroupsConfig
+}
+
+type groupRename struct {
+	from *regexp.Regexp
+	to   string
+}
+
+// Patterns always match the whole group name
+func compileGroupPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// The identity group prefix is added in front of GroupMapping.Prefix
+func NewGroupMapping(config GroupMappingConfig, identity IdentityConfig) (*GroupMapping, error) {
+	mapping := &GroupMapping{prefix: identity.GroupPrefix + config.Prefix, static: config.Static}
+	for _, static := range config.Static {
+		for _, group := range static.Groups {
+			if isReservedIdentity(group) {
+				return nil, fmt.Errorf("static group %v is a reserved identity", group)
+			}
+		}
+	}
+	for _, pattern := range config.Include {
+		expression, err := compileGroupPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		mapping.include = append(mapping.include, expression)
+	}
+	for _, pattern := range config.Exclude {
+		expression, err := compileGroupPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		mapping.exclude = append(mapping.exclude, expression)
+	}
+	for _, rename := range config.Rename {
+		expression, err := compileGroupPattern(rename.From)
+		if err != nil {
+			return nil, err
+		}
+		mapping.rename = append(mapping.rename, groupRename{from: expression, to: rename.To})
+	}
+	return mapping, nil
+}
+
+func matchesAny(expressions []*regexp.Regexp, group string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Map the LDAP groups of a user to Kubernetes groups.
+// When include or rename rules exist, groups not matched by any of them are dropped.
+// Mapped groups that are reserved Kubernetes identities are dropped, static groups are checked when loaded.
+func (mapping *GroupMapping) Map(username string, groups []string) []string {
+	filtered := len(mapping.include) > 0 || len(mapping.rename) > 0
+	var mapped []string
+	for _, group := range groups {
+		if matchesAny(mapping.exclude, group) {
+			continue
+		}
+		covered := !filtered || matchesAny(mapping.include, group)
+		for _, rename := range mapping.rename {
+			if rename.from.MatchString(group) {
+				group = rename.from.ReplaceAllString(group, rename.to)
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			continue
+		}
+		group = mapping.prefix + group
+		if !slices.Contains(mapped, group) {
+			mapped = append(mapped, group)
+		}
+	}
+	mapped = removeReservedGroups(username, mapped)
+	// Static groups for everyone or for listed users
+	for _, static := range mapping.static {
+		if len(static.Users) > 0 && !slices.Contains(static.Users, username) {
+			continue
+		}
+		for _, group := range static.Groups {
+			if !slices.Contains(mapped, group) {
+				mapped = append(mapped, group)
+			}
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_GroupMapping(t *testing.T) {
+	groups := []string{"k8s-prod-admins", "k8s-dev", "k8s-dev-legacy", "wifi-users", "k8s-dev"}
+	t.Run("No Rules", func(t *testing.T) {
+		mapping, err := NewGroupMapping(GroupMappingConfig{}, IdentityConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := mapping.Map("alice", groups)
+		expected := []string{"k8s-prod-admins", "k8s-dev", "k8s-dev-legacy", "wifi-users"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+	})
+	t.Run("Rules", func(t *testing.T) {
+		mapping, err := NewGroupMapping(GroupMappingConfig{
+			Include: []string{"k8s-.*"},
+			Exclude: []string{".*-legacy"},
+			Rename:  []GroupRenameConfig{{From: "k8s-prod-(.*)", To: "prod:$1"}},
+			Prefix:  "ldap:",
+			Static: []StaticGroupsConfig{
+				{Groups: []string{"everyone"}},
+				{Users: []string{"bob"}, Groups: []string{"bob-only"}},
+			},
+		}, IdentityConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := mapping.Map("alice", groups)
+		expected := []string{"ldap:prod:admins", "ldap:k8s-dev", "everyone"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+		mapped = mapping.Map("bob", nil)
+		expected = []string{"everyone", "bob-only"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+	})
+	t.Run("Rename Only Drops Uncovered", func(t *testing.T) {
+		mapping, err := NewGroupMapping(GroupMappingConfig{
+			Rename: []GroupRenameConfig{{From: "k8s-prod-admins", To: "prod:admins"}},
+		}, IdentityConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := mapping.Map("alice", groups)
+		expected := []string{"prod:admins"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+	})
+	t.Run("Group Prefix", func(t *testing.T) {
+		mapping, err := NewGroupMapping(GroupMappingConfig{Prefix: "k8s-"}, IdentityConfig{GroupPrefix: "ldap:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Prefixed reserved names are no longer reserved
+		mapped := mapping.Map("alice", []string{"system:masters", "dev"})
+		expected := []string{"ldap:k8s-system:masters", "ldap:k8s-dev"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+	})
+}
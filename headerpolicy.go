@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Good documentation:
+// https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
+
+// Headers that only describe the connection to the proxy
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Headers the proxy sets itself or that the client must never control
+var alwaysRemovedHeaders = []string{
+	"Authorization",
+	"Accept-Encoding",
+}
+
+// Identity headers only the proxy may set
+const IMPERSONATE_HEADER_PREFIX = "impersonate-"
+
+// Decides which client headers are forwarded to Kubernetes
+type HeaderPolicy struct {
+	deny map[string]bool
+}
+
+func NewHeaderPolicy(config HeaderPolicyConfig) *HeaderPolicy {
+	policy := &HeaderPolicy{deny: make(map[string]bool)}
+	for _, header := range alwaysRemovedHeaders {
+		policy.deny[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, header := range config.Deny {
+		policy.deny[http.CanonicalHeaderKey(header)] = true
+	}
+	return policy
+}
+
+func (policy *HeaderPolicy) allowed(key string, connectionHeaders map[string]bool) bool {
+	canonical := http.CanonicalHeaderKey(key)
+	if strings.HasPrefix(strings.ToLower(key), IMPERSONATE_HEADER_PREFIX) {
+		return false
+	}
+	for _, header := range hopByHopHeaders {
+		if canonical == header {
+			return false
+		}
+	}
+	return !policy.deny[canonical] && !connectionHeaders[canonical]
+}
+
+// Copy of the client headers that are safe to forward
+func (policy *HeaderPolicy) Filter(header http.Header) http.Header {
+	// Headers listed in Connection are hop-by-hop as well
+	connectionHeaders := make(map[string]bool)
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			connectionHeaders[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	filtered := make(http.Header)
+	for key, values := range header {
+		if policy.allowed(key, connectionHeaders) {
+			filtered[key] = values
+		}
+	}
+	return filtered
+}
+
+// Setting impersonation headders
+func setImpersonation(header http.Header, user *LDAPUser) {
+	header["Impersonate-User"] = []string{user.KubernetesUser}
+	header["Impersonate-Group"] = user.Groups
+	setImpersonateExtra(header, user)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func Test_HeaderPolicy(t *testing.T) {
+	policy := NewHeaderPolicy(HeaderPolicyConfig{Deny: []string{"x-debug-user"}})
+	client := http.Header{
+		"Accept":                   {"application/json"},
+		"Authorization":            {"Basic YWxpY2U6c2VjcmV0"},
+		"Impersonate-User":         {"system:admin"},
+		"Impersonate-Group":        {"system:masters"},
+		"Impersonate-Uid":          {"0"},
+		"Impersonate-Extra-Scopes": {"everything"},
+		// Not canonical, as a raw map write or HTTP/2 would give it
+		"impersonate-extra-reason": {"client"},
+		"Connection":               {"keep-alive, X-Hop"},
+		"X-Hop":                    {"1"},
+		"Keep-Alive":               {"timeout=5"},
+		"Transfer-Encoding":        {"chunked"},
+		"X-Debug-User":             {"admin"},
+	}
+	t.Run("Removed", func(t *testing.T) {
+		filtered := policy.Filter(client)
+		for key := range filtered {
+			if key != "Accept" {
+				t.Errorf("Error: %v forwarded", key)
+			}
+		}
+		if filtered.Get("Accept") != "application/json" {
+			t.Errorf("Error: Accept not forwarded")
+		}
+	})
+	t.Run("Client Can Not Add Identity", func(t *testing.T) {
+		user := &LDAPUser{User: "alice", KubernetesUser: "alice", Groups: []string{"developers"}, UID: "1234", Extra: map[string][]string{"email": {"alice@example.com"}}}
+		header := policy.Filter(client)
+		setImpersonation(header, user)
+		expected := http.Header{
+			"Accept":                  {"application/json"},
+			"Impersonate-User":        {"alice"},
+			"Impersonate-Group":       {"developers"},
+			"Impersonate-Uid":         {"1234"},
+			"Impersonate-Extra-email": {"alice@example.com"},
+		}
+		if len(header) != len(expected) {
+			t.Errorf("Error: %v != %v", header, expected)
+		}
+		for key, values := range expected {
+			if !slices.Equal(header[key], values) {
+				t.Errorf("Error: %v: %v != %v", key, header[key], values)
+			}
+		}
+	})
+	t.Run("Certificate Mode", func(t *testing.T) {
+		// Without impersonation no identity header may reach Kubernetes at all
+		for key := range policy.Filter(client) {
+			if strings.HasPrefix(strings.ToLower(key), IMPERSONATE_HEADER_PREFIX) {
+				t.Errorf("Error: %v forwarded", key)
+			}
+		}
+	})
+}
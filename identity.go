@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/access-authn-authz/rbac/#referring-to-subjects
+
+// Users and groups starting with this are Kubernetes system identities, system:masters is cluster admin
+const RESERVED_IDENTITY_PREFIX = "system:"
+
+func isReservedIdentity(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), RESERVED_IDENTITY_PREFIX)
+}
+
+// Username sent to Kubernetes, error if it is a reserved identity
+func (config *IdentityConfig) kubernetesUser(username string) (string, error) {
+	kubernetesUser := config.UsernamePrefix + username
+	if isReservedIdentity(kubernetesUser) {
+		log.Printf("@S Blocked reserved username %v for user %v\n", kubernetesUser, username)
+		return "", fmt.Errorf("username %v is reserved", kubernetesUser)
+	}
+	return kubernetesUser, nil
+}
+
+// Groups that are not reserved identities
+func removeReservedGroups(username string, groups []string) []string {
+	var allowed []string
+	for _, group := range groups {
+		if isReservedIdentity(group) {
+			log.Printf("@S Blocked reserved group %v for user %v\n", group, username)
+			continue
+		}
+		allowed = append(allowed, group)
+	}
+	return allowed
+}
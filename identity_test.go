@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_Identity(t *testing.T) {
+	t.Run("Reserved Groups", func(t *testing.T) {
+		mapping, err := NewGroupMapping(GroupMappingConfig{
+			Static: []StaticGroupsConfig{{Groups: []string{"everyone"}}},
+		}, IdentityConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := mapping.Map("alice", []string{"system:masters", "System:Nodes", "k8s-dev"})
+		expected := []string{"k8s-dev", "everyone"}
+		if !slices.Equal(mapped, expected) {
+			t.Errorf("Error: %v != %v", mapped, expected)
+		}
+	})
+	t.Run("Reserved Configured Groups", func(t *testing.T) {
+		if _, err := NewGroupMapping(GroupMappingConfig{
+			Static: []StaticGroupsConfig{{Users: []string{"alice"}, Groups: []string{"System:Masters"}}},
+		}, IdentityConfig{}); err == nil {
+			t.Errorf("Error: reserved static group accepted")
+		}
+		config := &MainConfig{LDAP: LDAPConfig{AccessGroups: []AccessGroupConfig{{Name: "kube-admins", KubernetesGroups: []string{"cluster-admins", "system:masters"}}}}}
+		if err := config.validateAccessGroups(); err == nil {
+			t.Errorf("Error: reserved KubernetesGroups accepted")
+		}
+	})
+	t.Run("Remove Reserved Groups", func(t *testing.T) {
+		allowed := removeReservedGroups("alice", []string{"SYSTEM:masters", "system:serviceaccounts", "dev-system:ops"})
+		if !slices.Equal(allowed, []string{"dev-system:ops"}) {
+			t.Errorf("Error: %v", allowed)
+		}
+	})
+	t.Run("Reserved Username", func(t *testing.T) {
+		if _, err := (&IdentityConfig{}).kubernetesUser("system:admin"); err == nil {
+			t.Errorf("Error: reserved username accepted")
+		}
+		username, err := (&IdentityConfig{UsernamePrefix: "ldap:"}).kubernetesUser("system:admin")
+		if err != nil || username != "ldap:system:admin" {
+			t.Errorf("Error: %v %v", username, err)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Good documentation:
+// https://pkg.go.dev/crypto/x509#MarshalPKCS8PrivateKey
+// https://kubernetes.io/docs/tasks/administer-cluster/certificates/
+
+const (
+	KEY_ALGORITHM_ECDSA   = "ecdsa"
+	KEY_ALGORITHM_RSA     = "rsa"
+	KEY_ALGORITHM_ED25519 = "ed25519"
+	KEY_SIZE_ECDSA        = 256
+	KEY_SIZE_RSA          = 3072
+	// PEM types of private keys. PKCS#8 is written, the others are read from older Secrets
+	TYPE_PKCS8_KEY = "PRIVATE KEY"
+	TYPE_RSA_KEY   = "RSA PRIVATE KEY"
+)
+
+var (
+	ecdsaKeySizes = []int{256, 384, 521}
+	rsaKeySizes   = []int{2048, 3072, 4096}
+)
+
+// Algorithm and size from configuration or the P-256 default
+func (config KeyConfig) withDefaults() KeyConfig {
+	config.Algorithm = strings.ToLower(config.Algorithm)
+	if len(config.Algorithm) == 0 {
+		config.Algorithm = KEY_ALGORITHM_ECDSA
+	}
+	if config.Size == 0 {
+		switch config.Algorithm {
+		case KEY_ALGORITHM_ECDSA:
+			config.Size = KEY_SIZE_ECDSA
+		case KEY_ALGORITHM_RSA:
+			config.Size = KEY_SIZE_RSA
+		}
+	}
+	return config
+}
+
+func (config KeyConfig) validate() error {
+	config = config.withDefaults()
+	switch config.Algorithm {
+	case KEY_ALGORITHM_ECDSA:
+		if !slices.Contains(ecdsaKeySizes, config.Size) {
+			return fmt.Errorf("unsupported %v key size %v, use one of %v", config.Algorithm, config.Size, ecdsaKeySizes)
+		}
+	case KEY_ALGORITHM_RSA:
+		if !slices.Contains(rsaKeySizes, config.Size) {
+			return fmt.Errorf("unsupported %v key size %v, use one of %v", config.Algorithm, config.Size, rsaKeySizes)
+		}
+	case KEY_ALGORITHM_ED25519:
+		if config.Size != 0 {
+			return fmt.Errorf("%v keys have no size", config.Algorithm)
+		}
+	default:
+		return fmt.Errorf("unknown key algorithm %v, use %v, %v or %v", config.Algorithm, KEY_ALGORITHM_ECDSA, KEY_ALGORITHM_RSA, KEY_ALGORITHM_ED25519)
+	}
+	return nil
+}
+
+func ellipticCurve(size int) elliptic.Curve {
+	switch size {
+	case 384:
+		return elliptic.P384()
+	case 521:
+		return elliptic.P521()
+	default:
+		return elliptic.P256()
+	}
+}
+
+func (config KeyConfig) generate() (crypto.Signer, error) {
+	config = config.withDefaults()
+	switch config.Algorithm {
+	case KEY_ALGORITHM_RSA:
+		return rsa.GenerateKey(rand.Reader, config.Size)
+	case KEY_ALGORITHM_ED25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return ecdsa.GenerateKey(ellipticCurve(config.Size), rand.Reader)
+	}
+}
+
+// Is key of the configured algorithm and size
+func (config KeyConfig) matches(key crypto.Signer) bool {
+	config = config.withDefaults()
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return config.Algorithm == KEY_ALGORITHM_ECDSA && k.Curve.Params().BitSize == config.Size
+	case *rsa.PrivateKey:
+		return config.Algorithm == KEY_ALGORITHM_RSA && k.N.BitLen() == config.Size
+	case ed25519.PrivateKey:
+		return config.Algorithm == KEY_ALGORITHM_ED25519
+	default:
+		return false
+	}
+}
+
+// Algorithm and size of key for logging
+func keyDescription(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return fmt.Sprintf("%v P-%v", KEY_ALGORITHM_ECDSA, k.Curve.Params().BitSize)
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("%v %v", KEY_ALGORITHM_RSA, k.N.BitLen())
+	case ed25519.PrivateKey:
+		return KEY_ALGORITHM_ED25519
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+// PKCS#8 PEM for any key type
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: TYPE_PKCS8_KEY, Bytes: der}), nil
+}
+
+// Read PKCS#8 keys and the EC and RSA keys of older Secrets
+func decodePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	switch block.Type {
+	case TYPE_PKCS8_KEY:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", key)
+		}
+		return signer, nil
+	case TYPE_PRIV_KEY:
+		return x509.ParseECPrivateKey(block.Bytes)
+	case TYPE_RSA_KEY:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("wrong keytype : %v", block.Type)
+	}
+}
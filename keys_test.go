@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_KeyAlgorithms(t *testing.T) {
+	ca := testCA(t, "test-client-ca")
+	signer, err := newLocalCASigner(SignerConfig{CACertificate: ca.GetPEMCert(), CAKey: ca.GetPEMKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []KeyConfig{
+		{},
+		{Algorithm: "ECDSA", Size: 384},
+		{Algorithm: KEY_ALGORITHM_RSA, Size: 2048},
+		{Algorithm: KEY_ALGORITHM_ED25519},
+	} {
+		t.Run(keyConfigName(config), func(t *testing.T) {
+			if err := config.validate(); err != nil {
+				t.Fatal(err)
+			}
+			cert := &Certificate{}
+			if err := cert.createKey(config); err != nil {
+				t.Fatal(err)
+			}
+			if !config.matches(cert.PrivateKey) {
+				t.Errorf("Error: %v does not match %+v", keyDescription(cert.PrivateKey), config)
+			}
+			csr, err := cert.createCSR("alice", "developers")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert.cert, err = signer.Sign("alice", csr, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Stored as PKCS#8 and read back
+			read, err := CertificateFromPEM("alice", cert.cert, cert.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !config.matches(read.PrivateKey) {
+				t.Errorf("Error: read %v does not match %+v", keyDescription(read.PrivateKey), config)
+			}
+			if _, err := read.GetTLSCert(); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		})
+	}
+	t.Run("Legacy EC Key", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodePrivateKey(pem.EncodeToMemory(&pem.Block{Type: TYPE_PRIV_KEY, Bytes: der}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !(KeyConfig{}).matches(decoded) {
+			t.Errorf("Error: legacy key %v does not match default", keyDescription(decoded))
+		}
+		if (KeyConfig{Algorithm: KEY_ALGORITHM_ECDSA, Size: 384}).matches(decoded) || (KeyConfig{Algorithm: KEY_ALGORITHM_RSA}).matches(decoded) {
+			t.Errorf("Error: legacy key %v matches other algorithms", keyDescription(decoded))
+		}
+	})
+	t.Run("Invalid Config", func(t *testing.T) {
+		for _, config := range []KeyConfig{
+			{Algorithm: "dsa"},
+			{Algorithm: KEY_ALGORITHM_ECDSA, Size: 224},
+			{Algorithm: KEY_ALGORITHM_RSA, Size: 1024},
+			{Algorithm: KEY_ALGORITHM_ED25519, Size: 256},
+		} {
+			if err := config.validate(); err == nil {
+				t.Errorf("Error: %+v accepted", config)
+			}
+		}
+	})
+}
+
+func keyConfigName(config KeyConfig) string {
+	config = config.withDefaults()
+	if config.Size == 0 {
+		return config.Algorithm
+	}
+	return fmt.Sprintf("%v-%v", config.Algorithm, config.Size)
+}
@@ -4,17 +4,19 @@ import (
 	"context"
 	"crypto/sha1"
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	v1 "k8s.io/api/certificates/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	apierros "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -32,10 +34,19 @@ type KubeClient struct {
 	expiration int32
 	clientset  *kubernetes.Clientset
 	context.Context
-	namespace   string
-	caCertPool  *x509.CertPool
-	certificate *tls.Certificate
-	bearerToken *string
+	namespace     string
+	config        *rest.Config
+	transport     http.RoundTripper
+	userTLSConfig *tls.Config
+	// Presents the front-proxy client certificate in front-proxy mode
+	frontProxyTransport http.RoundTripper
+	tokenTransport      http.RoundTripper
+	// API servers of the cluster, shared by the proxied requests and the clientset
+	endpoints *Endpoints
+	// Signs the client certificates of certificate mode
+	signer CertificateSigner
+	// Private keys of the client certificates
+	keyConfig KeyConfig
 }
 
 const (
@@ -74,51 +85,35 @@ func NewKubeClient(kubernetesConfig KubernetesConfig) (*KubeClient, error) {
 			return nil, err
 		}
 	}
-	// Get CA Certificate for cluster for usage in proxy mode
-	caCertPool := x509.NewCertPool()
-	if config.CAFile != "" {
-		caCert, err := os.ReadFile(config.CAFile)
-		if err != nil {
-			log.Printf("@I Error reading CA Certificate file (%v): %+v\n", config.CAFile, err)
-		} else {
-			log.Printf("@D Read CA Certificate from file (%v)\n", config.CAFile)
-			caCertPool.AppendCertsFromPEM(caCert)
-		}
+	err = applyUpstreamConfig(config, kubernetesConfig)
+	if err != nil {
+		return nil, err
 	}
-	if len(config.CAData) > 0 {
-		log.Printf("@D Read CA Certificate from CAData\n")
-		caCertPool.AppendCertsFromPEM(config.CAData)
+	client := &KubeClient{expiration: CERTIFICATE_EXPIRATION_SECONDS, Context: context.Background(), namespace: kubernetesConfig.Namespace, config: config}
+	err = client.createTransports(kubernetesConfig)
+	if err != nil {
+		return nil, err
 	}
-	client := &KubeClient{expiration: CERTIFICATE_EXPIRATION_SECONDS, Context: context.Background(), namespace: kubernetesConfig.Namespace, caCertPool: caCertPool}
-	if len(config.BearerToken) > 0 {
-		client.bearerToken = &config.BearerToken
-	} else {
-		var certificate tls.Certificate
-		if len(config.CertData) > 0 && len(config.KeyData) > 0 {
-			log.Printf("@D Read Certificate from CertData & KeyData\n")
-			certificate, err = tls.X509KeyPair(config.CertData, config.KeyData)
-			if err != nil {
-				log.Printf("@F Error reading Certificate From CertData && KeyData: %v\n", err.Error())
-				os.Exit(123)
-			} else {
-				client.certificate = &certificate
-			}
-		} else {
-			if (len(config.CertFile) > 0) && (len(config.KeyFile) > 0) {
-				log.Printf("@D Read Certificate from \n - CertFile: %v\n - KeyFile: %v\n", config.CertFile, config.KeyFile)
-				certificate, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
-				if err != nil {
-					log.Printf("@F Error reading Certificate From Kubeconfig: %v\n", err.Error())
-					os.Exit(123)
-				} else {
-					client.certificate = &certificate
-				}
-			}
-		}
+	err = client.createFrontProxyTransport(kubernetesConfig.FrontProxy)
+	if err != nil {
+		return nil, err
+	}
+	client.signer, err = NewCertificateSigner(kubernetesConfig.Signer, client)
+	if err != nil {
+		return nil, err
+	}
+	err = kubernetesConfig.Key.validate()
+	if err != nil {
+		return nil, err
+	}
+	client.keyConfig = kubernetesConfig.Key.withDefaults()
+	client.endpoints, err = NewEndpoints(kubernetesConfig, client)
+	if err != nil {
+		return nil, err
 	}
 
 	// create the clientset
-	client.clientset, err = kubernetes.NewForConfig(config)
+	err = client.createClientset()
 	if err != nil {
 		return nil, err
 	}
@@ -133,9 +128,9 @@ func (kube *KubeClient) DeleteCSR(name string) error {
 	return kube.clientset.CertificatesV1().CertificateSigningRequests().Delete(kube.Context, name, metav1.DeleteOptions{})
 }
 
-func (kube *KubeClient) GetSignedCertificate(name string) ([]byte, error) {
+func (kube *KubeClient) GetSignedCertificate(name string, timeout time.Duration) ([]byte, error) {
 	// Get signed certificate, This can take a few attempts. Will retry every 100 miliseconds
-	end := time.Now().Add(CERTIFICATE_FETCH_TIMEOUT_SECONDS * time.Second)
+	end := time.Now().Add(timeout)
 	for {
 		// Timeout
 		if time.Now().After(end) {
@@ -147,29 +142,45 @@ func (kube *KubeClient) GetSignedCertificate(name string) ([]byte, error) {
 			if apierros.IsNotFound(err) {
 				return nil, err
 			}
-		}
-		if csr.Status.Certificate != nil && len(csr.Status.Certificate) > 0 {
-			return csr.Status.Certificate, nil
+		} else {
+			if csr.Status.Certificate != nil && len(csr.Status.Certificate) > 0 {
+				return csr.Status.Certificate, nil
+			}
+			for _, condition := range csr.Status.Conditions {
+				if condition.Status != corev1.ConditionTrue {
+					continue
+				}
+				if condition.Type == v1.CertificateDenied {
+					return nil, &CSRError{Name: name, Denied: true, Reason: strings.TrimSpace(condition.Reason + " " + condition.Message)}
+				}
+				if condition.Type == v1.CertificateFailed {
+					return nil, &CSRError{Name: name, Reason: strings.TrimSpace("signing failed " + condition.Reason + " " + condition.Message)}
+				}
+			}
 		}
 		time.Sleep(time.Millisecond * CERTIFICATE_WAIT_TIMEOUT_MILISECONDS)
 	}
 	// Timeout
-	return nil, errors.New("timeout waiting for signed certificate")
+	return nil, &CSRError{Name: name, Pending: true, Reason: fmt.Sprintf("not signed within %v", timeout)}
 }
 
-func (kube *KubeClient) CreateCSR(name string, csr []byte) (*v1.CertificateSigningRequest, error) {
+func (kube *KubeClient) CreateCSR(name string, signerName string, csr []byte, lifetime time.Duration) (*v1.CertificateSigningRequest, error) {
 	// Create a CSR with a PEM Encoded []byte
+	expiration := kube.expiration
+	if lifetime > 0 {
+		expiration = int32(lifetime.Seconds())
+	}
 	return kube.clientset.CertificatesV1().CertificateSigningRequests().Create(kube.Context,
 		&v1.CertificateSigningRequest{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:   name,
 				Labels: map[string]string{"auth.stiil.dk/clientcertificates": "generated"},
 			}, Spec: v1.CertificateSigningRequestSpec{
-				// Required to be a client certificate for the API Server
-				SignerName: "kubernetes.io/kube-apiserver-client",
+				// kubernetes.io/kube-apiserver-client unless another signer is configured
+				SignerName: signerName,
 				// Required to be a client certificate for the API Server
 				Usages:            []v1.KeyUsage{v1.UsageClientAuth},
-				ExpirationSeconds: &kube.expiration,
+				ExpirationSeconds: &expiration,
 				Request:           csr,
 			}}, metav1.CreateOptions{})
 }
@@ -220,3 +231,93 @@ func (kube *KubeClient) DeleteSecret(name string) error {
 func (kube *KubeClient) updateSecret(name string, secretTemplate *corev1.Secret) (*corev1.Secret, error) {
 	return kube.clientset.CoreV1().Secrets(kube.namespace).Update(context.Background(), secretTemplate, metav1.UpdateOptions{})
 }
+
+func (kube *KubeClient) GetConfigMap(name string) (*corev1.ConfigMap, error) {
+	return kube.clientset.CoreV1().ConfigMaps(kube.namespace).Get(kube.Context, name, metav1.GetOptions{})
+}
+
+func (kube *KubeClient) CreateConfigMap(name string, configMapTemplate *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return kube.clientset.CoreV1().ConfigMaps(kube.namespace).Create(kube.Context, configMapTemplate, metav1.CreateOptions{})
+}
+
+func (kube *KubeClient) UpdateConfigMap(name string, configMapTemplate *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	return kube.clientset.CoreV1().ConfigMaps(kube.namespace).Update(kube.Context, configMapTemplate, metav1.UpdateOptions{})
+}
+
+func (kube *KubeClient) GetServiceAccount(name string) (*corev1.ServiceAccount, error) {
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).Get(kube.Context, name, metav1.GetOptions{})
+}
+
+func (kube *KubeClient) ListServiceAccounts(selector string) (*corev1.ServiceAccountList, error) {
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).List(kube.Context, metav1.ListOptions{LabelSelector: selector})
+}
+
+func (kube *KubeClient) CreateServiceAccount(serviceAccountTemplate *corev1.ServiceAccount) (*corev1.ServiceAccount, error) {
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).Create(kube.Context, serviceAccountTemplate, metav1.CreateOptions{})
+}
+
+func (kube *KubeClient) UpdateServiceAccount(serviceAccountTemplate *corev1.ServiceAccount) (*corev1.ServiceAccount, error) {
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).Update(kube.Context, serviceAccountTemplate, metav1.UpdateOptions{})
+}
+
+func (kube *KubeClient) DeleteServiceAccount(name string) error {
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).Delete(kube.Context, name, metav1.DeleteOptions{})
+}
+
+func (kube *KubeClient) CreateToken(name string, lifetime time.Duration) (*authenticationv1.TokenRequest, error) {
+	expiration := int64(lifetime.Seconds())
+	return kube.clientset.CoreV1().ServiceAccounts(kube.namespace).CreateToken(kube.Context, name,
+		&authenticationv1.TokenRequest{Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expiration}}, metav1.CreateOptions{})
+}
+
+func (kube *KubeClient) ListClusterRoleBindings(selector string) (*rbacv1.ClusterRoleBindingList, error) {
+	return kube.clientset.RbacV1().ClusterRoleBindings().List(kube.Context, metav1.ListOptions{LabelSelector: selector})
+}
+
+func (kube *KubeClient) ApplyClusterRoleBinding(binding *rbacv1.ClusterRoleBinding) error {
+	existing, err := kube.clientset.RbacV1().ClusterRoleBindings().Get(kube.Context, binding.Name, metav1.GetOptions{})
+	if apierros.IsNotFound(err) {
+		_, err = kube.clientset.RbacV1().ClusterRoleBindings().Create(kube.Context, binding, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	err = checkManagedBinding(existing.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	binding.ResourceVersion = existing.ResourceVersion
+	_, err = kube.clientset.RbacV1().ClusterRoleBindings().Update(kube.Context, binding, metav1.UpdateOptions{})
+	return err
+}
+
+func (kube *KubeClient) DeleteClusterRoleBinding(name string) error {
+	return kube.clientset.RbacV1().ClusterRoleBindings().Delete(kube.Context, name, metav1.DeleteOptions{})
+}
+
+func (kube *KubeClient) ListRoleBindings(selector string) (*rbacv1.RoleBindingList, error) {
+	return kube.clientset.RbacV1().RoleBindings(metav1.NamespaceAll).List(kube.Context, metav1.ListOptions{LabelSelector: selector})
+}
+
+func (kube *KubeClient) ApplyRoleBinding(binding *rbacv1.RoleBinding) error {
+	existing, err := kube.clientset.RbacV1().RoleBindings(binding.Namespace).Get(kube.Context, binding.Name, metav1.GetOptions{})
+	if apierros.IsNotFound(err) {
+		_, err = kube.clientset.RbacV1().RoleBindings(binding.Namespace).Create(kube.Context, binding, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	err = checkManagedBinding(existing.ObjectMeta)
+	if err != nil {
+		return err
+	}
+	binding.ResourceVersion = existing.ResourceVersion
+	_, err = kube.clientset.RbacV1().RoleBindings(binding.Namespace).Update(kube.Context, binding, metav1.UpdateOptions{})
+	return err
+}
+
+func (kube *KubeClient) DeleteRoleBinding(namespace string, name string) error {
+	return kube.clientset.RbacV1().RoleBindings(namespace).Delete(kube.Context, name, metav1.DeleteOptions{})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/config-api/kubeconfig.v1/#Cluster
+// https://curl.se/docs/manpage.html#--pinnedpubkey
+
+// Pins are the base64 sha256 of the SubjectPublicKeyInfo like curl --pinnedpubkey
+const CERTIFICATE_PIN_PREFIX = "sha256//"
+
+// Settings from configuration override the kubeconfig cluster entry
+func applyUpstreamConfig(config *rest.Config, kubernetesConfig KubernetesConfig) error {
+	if len(kubernetesConfig.TLSServerName) > 0 {
+		config.ServerName = kubernetesConfig.TLSServerName
+	}
+	if len(kubernetesConfig.ProxyURL) > 0 {
+		proxyURL, err := url.Parse(kubernetesConfig.ProxyURL)
+		if err != nil {
+			return err
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("unsupported proxy scheme %v", proxyURL.Scheme)
+		}
+		config.Proxy = http.ProxyURL(proxyURL)
+	}
+	// The clientset is built for the first configured API server, its requests fail over through the endpoints
+	if servers := configuredServers(kubernetesConfig); len(servers) > 0 {
+		config.Host = normalizeServer(servers[0])
+	}
+	return nil
+}
+
+// Build the transports used toward the API server from the same rest.Config as the clientset
+func (kube *KubeClient) createTransports(kubernetesConfig KubernetesConfig) error {
+	minVersion, err := parseTLSVersion(kubernetesConfig.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	pins, err := parseCertificatePins(kubernetesConfig.CertificatePins)
+	if err != nil {
+		return err
+	}
+	harden := func(tlsConfig *tls.Config) *tls.Config {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if minVersion > 0 {
+			tlsConfig.MinVersion = minVersion
+		}
+		if len(pins) > 0 {
+			tlsConfig.VerifyPeerCertificate = verifyCertificatePins(pins)
+		}
+		return tlsConfig
+	}
+	// Transport with the proxy's own credentials for impersonation mode.
+	// Token files are re-read and exec or auth-provider plugins refresh their credentials.
+	tlsConfig, err := rest.TLSConfigFor(kube.config)
+	if err != nil {
+		return err
+	}
+	kube.transport, err = rest.HTTPWrappersForConfig(kube.config, kube.newTransport(harden(tlsConfig)))
+	if err != nil {
+		return err
+	}
+	// Only trust the cluster CA, the user certificate is added per request in certificate mode
+	userTLSConfig, err := rest.TLSConfigFor(rest.AnonymousClientConfig(kube.config))
+	if err != nil {
+		return err
+	}
+	kube.userTLSConfig = harden(userTLSConfig)
+	// Bearer tokens are set per request in serviceaccount mode
+	kube.tokenTransport = kube.newTransport(kube.userTLSConfig)
+	return nil
+}
+
+// Clientset for CSRs, Secrets and tokens on the hardened transport, so pins and the minimum TLS version apply to it too.
+// With endpoints its requests go to a healthy API server like proxied requests.
+func (kube *KubeClient) createClientset() error {
+	transport := kube.transport
+	if kube.endpoints != nil {
+		transport = &endpointsTransport{endpoints: kube.endpoints, base: kube.config.Host, client: &http.Client{
+			Transport: kube.transport,
+			// The clientset handles redirects itself
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}}
+	}
+	var err error
+	kube.clientset, err = kubernetes.NewForConfigAndClient(kube.config, &http.Client{Transport: transport, Timeout: kube.config.Timeout})
+	return err
+}
+
+func (kube *KubeClient) newTransport(tlsConfig *tls.Config) *http.Transport {
+	return utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:           kube.config.Proxy,
+		TLSClientConfig: tlsConfig,
+	})
+}
+
+// Transport authenticating with a user certificate instead of the proxy's credentials
+func (kube *KubeClient) userTransport(certificate tls.Certificate) http.RoundTripper {
+	tlsConfig := kube.userTLSConfig.Clone()
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+	return kube.newTransport(tlsConfig)
+}
+
+// API servers from configuration: Hosts, Server or Host. Empty if the kubeconfig server is used
+func configuredServers(kubernetesConfig KubernetesConfig) []string {
+	switch {
+	case len(kubernetesConfig.Hosts) > 0:
+		return kubernetesConfig.Hosts
+	case len(kubernetesConfig.Server) > 0:
+		return []string{kubernetesConfig.Server}
+	case len(kubernetesConfig.Host) > 0:
+		return []string{kubernetesConfig.Host}
+	default:
+		return nil
+	}
+}
+
+// Base URLs of the API servers: Hosts, Server, Host or the kubeconfig server
+func (kube *KubeClient) servers(kubernetesConfig KubernetesConfig) []string {
+	servers := configuredServers(kubernetesConfig)
+	if len(servers) == 0 {
+		servers = []string{kube.config.Host}
+	}
+	var normalized []string
+	for _, server := range servers {
+		normalized = append(normalized, normalizeServer(server))
+	}
+	return normalized
+}
+
+// host:port is https://host:port, a path prefix is kept for API servers behind a gateway
+func normalizeServer(server string) string {
+	if !strings.Contains(server, "://") {
+		server = "https://" + server
+	}
+	return strings.TrimSuffix(server, "/")
+}
+
+func certificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return CERTIFICATE_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func parseCertificatePins(pins []string) ([]string, error) {
+	for _, pin := range pins {
+		if !strings.HasPrefix(pin, CERTIFICATE_PIN_PREFIX) {
+			return nil, fmt.Errorf("certificate pin %v must start with %v", pin, CERTIFICATE_PIN_PREFIX)
+		}
+	}
+	return pins, nil
+}
+
+// The API server certificate must match a pin on top of the normal CA verification
+func verifyCertificatePins(pins []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no API server certificate to verify pin")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if pin := certificatePin(cert); !slices.Contains(pins, pin) {
+			return fmt.Errorf("API server certificate pin %v not allowed", pin)
+		}
+		return nil
+	}
+}
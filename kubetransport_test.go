@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func Test_KubeTransport(t *testing.T) {
+	t.Run("Servers", func(t *testing.T) {
+		for server, expected := range map[string]string{
+			"api.example.com:6443":             "https://api.example.com:6443",
+			"https://gateway.example.com/k8s/": "https://gateway.example.com/k8s",
+			"http://localhost:8001":            "http://localhost:8001",
+		} {
+			if normalized := normalizeServer(server); normalized != expected {
+				t.Errorf("Error: %v != %v", normalized, expected)
+			}
+		}
+	})
+	t.Run("Certificate Pin", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+		pin := certificatePin(server.Certificate())
+		for _, test := range []struct {
+			pins []string
+			ok   bool
+		}{
+			{[]string{pin}, true},
+			{[]string{"sha256//AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, false},
+		} {
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.VerifyPeerCertificate = verifyCertificatePins(test.pins)
+			response, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err == nil) != test.ok {
+				t.Errorf("Error: pins %v: %v", test.pins, err)
+			}
+		}
+		if _, err := parseCertificatePins([]string{"AAAA"}); err == nil {
+			t.Errorf("Error: pin without prefix accepted")
+		}
+	})
+	t.Run("TLS Settings", func(t *testing.T) {
+		config := &rest.Config{Host: "https://api.example.com", BearerToken: "token"}
+		kubernetesConfig := KubernetesConfig{TLSMinVersion: "1.3", TLSServerName: "kubernetes.default", ProxyURL: "socks5://proxy.example.com:1080"}
+		if err := applyUpstreamConfig(config, kubernetesConfig); err != nil {
+			t.Fatal(err)
+		}
+		kube := &KubeClient{config: config}
+		if err := kube.createTransports(kubernetesConfig); err != nil {
+			t.Fatal(err)
+		}
+		if kube.userTLSConfig.MinVersion != tls.VersionTLS13 || kube.userTLSConfig.ServerName != "kubernetes.default" {
+			t.Errorf("Error: unexpected TLS config %+v", kube.userTLSConfig)
+		}
+		request, _ := http.NewRequest(http.MethodGet, "https://api.example.com/api", nil)
+		if proxyURL, err := config.Proxy(request); err != nil || proxyURL.String() != "socks5://proxy.example.com:1080" {
+			t.Errorf("Error: proxy %v %v", proxyURL, err)
+		}
+		if servers := kube.servers(KubernetesConfig{}); len(servers) != 1 || servers[0] != "https://api.example.com" {
+			t.Errorf("Error: kubeconfig server not used %v", servers)
+		}
+		if config.Host != "https://api.example.com" {
+			t.Errorf("Error: kubeconfig server replaced %v", config.Host)
+		}
+		if err := applyUpstreamConfig(config, KubernetesConfig{Hosts: []string{"api-1.example.com:6443", "api-2.example.com:6443"}}); err != nil || config.Host != "https://api-1.example.com:6443" {
+			t.Errorf("Error: clientset host %v %v", config.Host, err)
+		}
+	})
+	t.Run("Pinned Clientset", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"alice"}}`))
+		}))
+		defer server.Close()
+		caData := pem.EncodeToMemory(&pem.Block{Type: TYPE_CERTIFICATE, Bytes: server.Certificate().Raw})
+		for _, test := range []struct {
+			pins []string
+			ok   bool
+		}{
+			{[]string{certificatePin(server.Certificate())}, true},
+			{[]string{"sha256//AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, false},
+		} {
+			config := &rest.Config{Host: server.URL, TLSClientConfig: rest.TLSClientConfig{CAData: caData}}
+			kubernetesConfig := KubernetesConfig{CertificatePins: test.pins}
+			kube := &KubeClient{config: config}
+			if err := kube.createTransports(kubernetesConfig); err != nil {
+				t.Fatal(err)
+			}
+			if err := kube.createClientset(); err != nil {
+				t.Fatal(err)
+			}
+			_, err := kube.clientset.CoreV1().Secrets("kube-auth-proxy").Get(context.Background(), "alice", metav1.GetOptions{})
+			if (err == nil) != test.ok {
+				t.Errorf("Error: pins %v: %v", test.pins, err)
+			}
+		}
+	})
+}
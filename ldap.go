@@ -1,11 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"strings"
 
 	"crypto/tls"
-	"crypto/x509"
 
 	ldap "github.com/go-ldap/ldap/v3"
 )
@@ -24,29 +25,76 @@ func (auth *LDAPAuth) SetMembershipAtributes(Filter string) {
 }
 
 func (auth *LDAPAuth) dialServer() (*ldap.Conn, error) {
-	// Handle special situation when using a non standart RootCA
-	if len(auth.CACertificate) > 0 && auth.Config == nil {
-		cert := []byte(auth.CACertificate)
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(cert)
-		auth.Config = &tls.Config{
-			RootCAs: caCertPool,
+	// Handle special situation when using a non standart RootCA or client certificate
+	if auth.Config == nil && auth.hasTLSSettings() {
+		config, err := auth.tlsConfig()
+		if err != nil {
+			return nil, err
 		}
+		auth.Config = config
 	}
+	var conn *ldap.Conn
+	var err error
 	if auth.Config != nil {
-		return ldap.DialURL(auth.URL, ldap.DialWithTLSConfig(auth.Config))
+		conn, err = ldap.DialURL(auth.URL, ldap.DialWithTLSConfig(auth.Config))
 	} else {
-		return ldap.DialURL(auth.URL)
+		conn, err = ldap.DialURL(auth.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if auth.StartTLS {
+		config := auth.Config
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if len(config.ServerName) == 0 {
+			// StartTLS does not know the hostname from the URL
+			config = config.Clone()
+			config.ServerName = ldapHostname(auth.URL)
+		}
+		err = conn.StartTLS(config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Bind as the service user used for searches
+func (auth *LDAPAuth) serviceBind(conn *ldap.Conn) error {
+	switch auth.BindMethod {
+	case LDAP_BIND_EXTERNAL:
+		// Identity comes from the client certificate of the TLS connection
+		return conn.ExternalBind()
+	case LDAP_BIND_SIMPLE, "":
+		return conn.Bind(auth.BindDN, auth.BindPassword)
+	default:
+		return fmt.Errorf("unknown LDAP bind method %v", auth.BindMethod)
 	}
 }
 
 type LDAPUser struct {
-	User   string
+	User string
+	// Groups as read from LDAP
+	LDAPGroups []string
+	// Access groups that granted the login, in configuration order
+	AccessGroups []string
+	// Username sent to Kubernetes with Identity.UsernamePrefix
+	KubernetesUser string
+	// Groups sent to Kubernetes after mapping
 	Groups []string
+	// Stable id from LDAP.UIDAttribute
+	UID string
+	// Values of LDAP.ExtraAttributes by key
+	Extra map[string][]string
+	// Nested impersonation requested by the user
+	Target *ImpersonationTarget
 }
 
 func (auth *LDAPAuth) LookupGroup(conn *ldap.Conn, group string) (*ldap.Entry, error) {
-	groupFilter := fmt.Sprintf(auth.SearchGroupFilter, group)
+	groupFilter := fmt.Sprintf(auth.SearchGroupFilter, ldap.EscapeFilter(group))
 	searchReq := ldap.NewSearchRequest(auth.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, groupFilter, []string{"displayName"}, []ldap.Control{})
 	result, err := conn.Search(searchReq)
 	if err != nil {
@@ -64,14 +112,32 @@ func (auth *LDAPAuth) LookupGroup(conn *ldap.Conn, group string) (*ldap.Entry, e
 }
 
 func (auth *LDAPAuth) findGroupIdentifier(entry *ldap.Entry) string {
-	return strings.TrimPrefix(entry.DN, fmt.Sprintf("cn=%s", auth.Group))
+	// Everything after the group RDN, the common suffix of groups next to it
+	if _, parent, found := strings.Cut(entry.DN, ","); found {
+		return "," + parent
+	}
+	return entry.DN
 }
 func (auth *LDAPAuth) ListGroups(groupEntry *ldap.Entry, userEntry *ldap.Entry) []string {
+	return auth.groupNames(groupEntry, groupsFromDNs(userEntry.GetAttributeValues("memberOf")))
+}
+
+func (auth *LDAPAuth) groupNames(groupEntry *ldap.Entry, groups []ldapGroup) []string {
 	groupIdentifier := auth.findGroupIdentifier(groupEntry)
-	groups := userEntry.GetAttributeValues("memberOf")
 	var groupstrings []string
 	for _, group := range groups {
-		str := strings.TrimSuffix(group, groupIdentifier)
+		if len(group.Name) > 0 {
+			groupstrings = append(groupstrings, group.Name)
+			continue
+		}
+		if auth.Schema == LDAP_SCHEMA_ACTIVEDIRECTORY {
+			// Active Directory groups are spread over OUs, only the CN is the name
+			if name, ok := commonNameFromDN(group.DN); ok {
+				groupstrings = append(groupstrings, name)
+				continue
+			}
+		}
+		str := strings.TrimSuffix(group.DN, groupIdentifier)
 		str = strings.TrimPrefix(str, "cn=")
 		str = strings.ReplaceAll(str, " ", "")
 		groupstrings = append(groupstrings, str)
@@ -79,9 +145,27 @@ func (auth *LDAPAuth) ListGroups(groupEntry *ldap.Entry, userEntry *ldap.Entry)
 	return groupstrings
 }
 
+func (auth *LDAPAuth) userFilter(username string, groupDN string) string {
+	filter := auth.SearchUserFilter
+	if auth.NestedGroups == NESTED_GROUPS_INCHAIN {
+		// Let Active Directory check the membership through nested groups
+		filter = strings.ReplaceAll(filter, "(memberOf=", "(memberOf:"+LDAP_MATCHING_RULE_IN_CHAIN+":=")
+	}
+	// Values are escaped so usernames like *)(uid=* can not change the filter
+	return fmt.Sprintf(filter, ldap.EscapeFilter(username), ldap.EscapeFilter(groupDN))
+}
+
 func (auth *LDAPAuth) LookupUser(conn *ldap.Conn, username string, groupDN string) (*ldap.Entry, error) {
-	userFilter := fmt.Sprintf(auth.SearchUserFilter, username, groupDN)
-	searchReq := ldap.NewSearchRequest(auth.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, userFilter, []string{"displayName", "memberOf"}, []ldap.Control{})
+	return auth.searchUser(conn, username, auth.userFilter(username, groupDN))
+}
+
+// Lookup a user without checking group membership
+func (auth *LDAPAuth) LookupLogin(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	return auth.searchUser(conn, username, fmt.Sprintf(auth.SearchLoginFilter, ldap.EscapeFilter(username)))
+}
+
+func (auth *LDAPAuth) searchUser(conn *ldap.Conn, username string, userFilter string) (*ldap.Entry, error) {
+	searchReq := ldap.NewSearchRequest(auth.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, userFilter, auth.userAttributes(), []ldap.Control{})
 	result, err := conn.Search(searchReq)
 	if err != nil {
 		return nil, err
@@ -98,41 +182,172 @@ func (auth *LDAPAuth) LookupUser(conn *ldap.Conn, username string, groupDN strin
 	return result.Entries[0], nil
 }
 
-func (auth *LDAPAuth) TestLogin(Username string, Password string) (*LDAPUser, error) {
-	// Create server conntction
-	conn, err := auth.dialServer()
-	if err != nil {
-		return nil, err
+// The username as typed by the user, reduced to what the directory can search for
+func (auth *LDAPAuth) normalizeUsername(username string) string {
+	if auth.Schema == LDAP_SCHEMA_ACTIVEDIRECTORY {
+		return normalizeActiveDirectoryUsername(username)
 	}
-	defer conn.Close()
+	return username
+}
+
+// One username per user no matter how it was typed at login.
+// Taken from UsernameAttribute of the entry so Alice and alice are the same Kubernetes user.
+func (auth *LDAPAuth) canonicalUsername(userEntry *ldap.Entry, username string) string {
+	if len(auth.UsernameAttribute) > 0 {
+		if canonical := userEntry.GetAttributeValue(auth.UsernameAttribute); len(canonical) > 0 {
+			return canonical
+		}
+		log.Printf("@I user %v has no %v attribute, using username as typed\n", userEntry.DN, auth.UsernameAttribute)
+	}
+	return username
+}
+
+// A user found as a member of one or more access groups
+type ldapMember struct {
+	userEntry    *ldap.Entry
+	groupEntry   *ldap.Entry
+	groups       []ldapGroup
+	accessGroups []string
+}
+
+// Find the user if it is a member of an access group, directly or through nested groups.
+// Returns nil if the user is not found or not a member of any access group.
+func (auth *LDAPAuth) findMember(conn *ldap.Conn, Username string) (*ldapMember, error) {
 	// Login with main user for group and user search
-	err = conn.Bind(auth.BindDN, auth.BindPassword)
+	err := auth.serviceBind(conn)
 	if err != nil {
 		return nil, err
 	}
 
-	// Lookup group
-	groupEntry, err := auth.LookupGroup(conn, auth.Group)
-	if err != nil {
-		return nil, err
+	// Lookup groups
+	var groupEntries []*ldap.Entry
+	var groupNames []string
+	for _, accessGroup := range auth.accessGroups() {
+		groupEntry, err := auth.LookupGroup(conn, accessGroup.Name)
+		if err != nil {
+			log.Printf("@E Access group %v: %+v\n", accessGroup.Name, err)
+			continue
+		}
+		groupEntries = append(groupEntries, groupEntry)
+		groupNames = append(groupNames, accessGroup.Name)
+	}
+	if len(groupEntries) == 0 {
+		return nil, errors.New("none of the access groups were found")
 	}
 
 	// Lookup User
-	userEntry, err := auth.LookupUser(conn, Username, groupEntry.DN)
-	if userEntry == nil && err == nil {
+	member := &ldapMember{}
+	// Membership can only be known after searching or walking the groups
+	membershipInFilter := auth.NestedGroups != NESTED_GROUPS_WALK && auth.GroupMembership != GROUP_MEMBERSHIP_SEARCH
+	if membershipInFilter {
+		for i, groupEntry := range groupEntries {
+			member.userEntry, err = auth.LookupUser(conn, Username, groupEntry.DN)
+			if err != nil {
+				return nil, err
+			}
+			if member.userEntry != nil {
+				member.groupEntry = groupEntry
+				member.accessGroups = append(member.accessGroups, groupNames[i])
+				break
+			}
+		}
+	} else {
+		member.userEntry, err = auth.LookupLogin(conn, Username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if member.userEntry == nil {
 		return nil, nil
 	}
+	member.groups, err = auth.resolveGroups(conn, member.userEntry, auth.canonicalUsername(member.userEntry, Username))
 	if err != nil {
 		return nil, err
 	}
+	// Record every access group the user is a member of
+	for i, groupEntry := range groupEntries {
+		if groupEntry != member.groupEntry && containsGroup(member.groups, groupEntry.DN) {
+			if member.groupEntry == nil {
+				member.groupEntry = groupEntry
+			}
+			member.accessGroups = append(member.accessGroups, groupNames[i])
+		}
+	}
+	if len(member.accessGroups) == 0 {
+		log.Printf("@I user %v is not a member of any access group\n", Username)
+		return nil, nil
+	}
+	return member, nil
+}
 
-	err = conn.Bind(userEntry.DN, Password)
+func (auth *LDAPAuth) newUser(member *ldapMember, Username string) *LDAPUser {
+	return &LDAPUser{
+		User:         auth.canonicalUsername(member.userEntry, Username),
+		LDAPGroups:   auth.groupNames(member.groupEntry, member.groups),
+		AccessGroups: member.accessGroups,
+		UID:          auth.userUID(member.userEntry),
+		Extra:        auth.userExtra(member.userEntry),
+	}
+}
+
+// Check that a user is still a member of the group without knowing the password.
+// Used for users already authenticated in other ways.
+func (auth *LDAPAuth) TestMember(Username string) (*LDAPUser, error) {
+	conn, err := auth.dialServer()
 	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	Username = auth.normalizeUsername(Username)
+	member, err := auth.findMember(conn, Username)
+	if member == nil || err != nil {
+		return nil, err
+	}
+	return auth.newUser(member, Username), nil
+}
+
+// Called with the canonical username before the password is checked, an error stops the login
+type loginGuard func(username string) error
+
+// Returns the user on success and the canonical username if the user was found, also when the password is wrong
+func (auth *LDAPAuth) TestLogin(Username string, Password string, guard loginGuard) (*LDAPUser, string, error) {
+	// Create server conntction
+	conn, err := auth.dialServer()
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	Username = auth.normalizeUsername(Username)
+	member, err := auth.findMember(conn, Username)
+	if member == nil && err == nil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	// DOMAIN\user, user@domain and user are the same user from here
+	canonical := auth.canonicalUsername(member.userEntry, Username)
+	if guard != nil {
+		err = guard(canonical)
+		if err != nil {
+			return nil, canonical, err
+		}
+	}
+
+	err = conn.Bind(member.userEntry.DN, Password)
+	if err != nil {
+		if auth.Schema == LDAP_SCHEMA_ACTIVEDIRECTORY {
+			// Active Directory tells why, expired and locked accounts are not server errors
+			if reason := activeDirectoryBindFailure(err); len(reason) > 0 {
+				log.Printf("@I LDAP bind for user %v rejected: %v\n", Username, reason)
+				return nil, canonical, nil
+			}
+		}
 		if ldap.IsErrorAnyOf(err, 49) {
-			return nil, nil
+			return nil, canonical, nil
 		}
-		return nil, err
+		return nil, canonical, err
 	} else {
-		return &LDAPUser{User: Username, Groups: auth.ListGroups(groupEntry, userEntry)}, nil
+		return auth.newUser(member, Username), canonical, nil
 	}
 }
@@ -70,3 +70,15 @@ func Test_Ldap(t *testing.T) {
 	})
 
 }
+
+func Test_LdapUserFilter(t *testing.T) {
+	auth := &LDAPAuth{LDAPConfig: LDAPConfig{SearchUserFilter: "(&(uid=%s)(memberOf=%s))"}}
+	filter := auth.userFilter("*)(uid=*", "cn=readers,ou=groups,dc=example,dc=com")
+	expected := `(&(uid=\2a\29\28uid=\2a)(memberOf=cn=readers,ou=groups,dc=example,dc=com))`
+	if filter != expected {
+		t.Errorf("Error: %s != %s", filter, expected)
+	}
+	if _, err := ldap.CompileFilter(filter); err != nil {
+		t.Errorf("Error: escaped filter does not compile: %s", err.Error())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
+// https://learn.microsoft.com/en-us/windows/win32/adschema/a-objectguid
+
+const (
+	ACTIVEDIRECTORY_UID      = "objectGUID"
+	HEADER_IMPERSONATE_UID   = "Impersonate-Uid"
+	HEADER_IMPERSONATE_EXTRA = "Impersonate-Extra-"
+)
+
+// Attributes of the user entry to fetch on lookup
+func (auth *LDAPAuth) userAttributes() []string {
+	attributes := []string{"displayName", "memberOf"}
+	if len(auth.UsernameAttribute) > 0 {
+		attributes = append(attributes, auth.UsernameAttribute)
+	}
+	if len(auth.UIDAttribute) > 0 {
+		attributes = append(attributes, auth.UIDAttribute)
+	}
+	for _, extra := range auth.ExtraAttributes {
+		attributes = append(attributes, extra.Attribute)
+	}
+	return attributes
+}
+
+// Extra values keyed as configured, attributes missing on the entry are left out
+func (auth *LDAPAuth) userExtra(userEntry *ldap.Entry) map[string][]string {
+	if len(auth.ExtraAttributes) == 0 {
+		return nil
+	}
+	extra := make(map[string][]string)
+	for _, attribute := range auth.ExtraAttributes {
+		values := userEntry.GetAttributeValues(attribute.Attribute)
+		if len(values) > 0 {
+			extra[attribute.Key] = append(extra[attribute.Key], values...)
+		}
+	}
+	return extra
+}
+
+// Stable id of the user, objectGUID is binary and formatted as a GUID string
+func (auth *LDAPAuth) userUID(userEntry *ldap.Entry) string {
+	if len(auth.UIDAttribute) == 0 {
+		return ""
+	}
+	if strings.EqualFold(auth.UIDAttribute, ACTIVEDIRECTORY_UID) {
+		return formatObjectGUID(userEntry.GetRawAttributeValue(auth.UIDAttribute))
+	}
+	return userEntry.GetAttributeValue(auth.UIDAttribute)
+}
+
+// objectGUID is stored with the first three groups little endian
+func formatObjectGUID(guid []byte) string {
+	if len(guid) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x",
+		[]byte{guid[3], guid[2], guid[1], guid[0]},
+		[]byte{guid[5], guid[4]},
+		[]byte{guid[7], guid[6]},
+		guid[8:10], guid[10:])
+}
+
+// Extra keys are case insensitive and percent encoded in the header name
+func impersonateExtraHeader(key string) string {
+	return HEADER_IMPERSONATE_EXTRA + url.PathEscape(strings.ToLower(key))
+}
+
+func setImpersonateExtra(header http.Header, user *LDAPUser) {
+	if len(user.UID) > 0 {
+		header[HEADER_IMPERSONATE_UID] = []string{user.UID}
+	}
+	for key, values := range user.Extra {
+		header[impersonateExtraHeader(key)] = values
+	}
+}
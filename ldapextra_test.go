@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+func Test_LdapExtra(t *testing.T) {
+	auth := &LDAPAuth{LDAPConfig: LDAPConfig{
+		UIDAttribute: "entryUUID",
+		ExtraAttributes: []ExtraAttributeConfig{
+			{Attribute: "mail", Key: "email"},
+			{Attribute: "employeeNumber", Key: "example.com/Employee-ID"},
+			{Attribute: "departmentNumber", Key: "department"},
+		},
+	}}
+	entry := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+		"entryUUID":      {"0f8c2a8e-5b1d-4c3e-9a7f-1d2e3f4a5b6c"},
+		"mail":           {"alice@example.com"},
+		"employeeNumber": {"1234"},
+	})
+	t.Run("Attributes", func(t *testing.T) {
+		attributes := auth.userAttributes()
+		for _, attribute := range []string{"entryUUID", "mail", "employeeNumber", "departmentNumber"} {
+			if !slices.Contains(attributes, attribute) {
+				t.Errorf("Error: %v not in %v", attribute, attributes)
+			}
+		}
+	})
+	t.Run("Headers", func(t *testing.T) {
+		user := &LDAPUser{User: "alice", UID: auth.userUID(entry), Extra: auth.userExtra(entry)}
+		header := make(http.Header)
+		setImpersonateExtra(header, user)
+		expected := map[string]string{
+			"Impersonate-Uid":                             "0f8c2a8e-5b1d-4c3e-9a7f-1d2e3f4a5b6c",
+			"Impersonate-Extra-email":                     "alice@example.com",
+			"Impersonate-Extra-example.com%2Femployee-id": "1234",
+		}
+		for key, value := range expected {
+			if values := header[key]; len(values) != 1 || values[0] != value {
+				t.Errorf("Error: %v: %v != %v", key, values, value)
+			}
+		}
+		if _, ok := header["Impersonate-Extra-department"]; ok {
+			t.Errorf("Error: missing attribute sent as extra")
+		}
+	})
+	t.Run("Object GUID", func(t *testing.T) {
+		guid := []byte{0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}
+		if formatted := formatObjectGUID(guid); formatted != "12345678-1234-5678-1234-56789abcdef0" {
+			t.Errorf("Error: %v", formatted)
+		}
+	})
+}
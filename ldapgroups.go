@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Good documentation:
+// https://learn.microsoft.com/en-us/windows/win32/adsi/search-filter-syntax
+// https://ldapwiki.com/wiki/Wiki.jsp?page=1.2.840.113556.1.4.1941
+
+const (
+	NESTED_GROUPS_NONE = ""
+	// Active Directory resolves nested groups with LDAP_MATCHING_RULE_IN_CHAIN
+	NESTED_GROUPS_INCHAIN = "inchain"
+	// Walk the memberships of the groups on any LDAP server
+	NESTED_GROUPS_WALK          = "walk"
+	LDAP_MATCHING_RULE_IN_CHAIN = "1.2.840.113556.1.4.1941"
+	NESTED_GROUPS_DEPTH         = 10
+	// Memberships read from the memberOf attribute of the user
+	GROUP_MEMBERSHIP_MEMBEROF = "memberof"
+	// Memberships found by searching groups for the user
+	GROUP_MEMBERSHIP_SEARCH = "search"
+	GROUP_SEARCH_FILTER     = "(|(member=%dn)(uniqueMember=%dn)(memberUid=%uid))"
+	// Groups are found by DN only, memberUid holds usernames and would match users named like the group
+	GROUP_PARENT_SEARCH_FILTER = "(|(member=%dn)(uniqueMember=%dn))"
+)
+
+// The part of *ldap.Conn used for resolving groups
+type ldapSearcher interface {
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+// A group the user is a member of. Name is empty when it should be taken from the DN
+type ldapGroup struct {
+	DN   string
+	Name string
+}
+
+func groupsFromDNs(dns []string) []ldapGroup {
+	var groups []ldapGroup
+	for _, dn := range dns {
+		groups = append(groups, ldapGroup{DN: dn})
+	}
+	return groups
+}
+
+// All groups the user is a member of, including nested groups if enabled
+func (auth *LDAPAuth) resolveGroups(conn ldapSearcher, userEntry *ldap.Entry, username string) ([]ldapGroup, error) {
+	var direct []ldapGroup
+	var err error
+	if auth.NestedGroups == NESTED_GROUPS_INCHAIN {
+		return auth.inChainGroups(conn, userEntry.DN)
+	}
+	if auth.GroupMembership == GROUP_MEMBERSHIP_SEARCH {
+		direct, err = auth.searchGroups(conn, userEntry.DN, username)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		direct = groupsFromDNs(userEntry.GetAttributeValues("memberOf"))
+	}
+	switch auth.NestedGroups {
+	case NESTED_GROUPS_NONE:
+		return direct, nil
+	case NESTED_GROUPS_WALK:
+		return auth.walkGroups(conn, direct)
+	default:
+		return nil, fmt.Errorf("unknown nested groups mode %v", auth.NestedGroups)
+	}
+}
+
+// Ask Active Directory for all groups with the user as a member through any chain
+func (auth *LDAPAuth) inChainGroups(conn ldapSearcher, userDN string) ([]ldapGroup, error) {
+	filter := fmt.Sprintf("(member:%s:=%s)", LDAP_MATCHING_RULE_IN_CHAIN, ldap.EscapeFilter(userDN))
+	searchReq := ldap.NewSearchRequest(auth.BaseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{"dn"}, []ldap.Control{})
+	result, err := conn.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	var groups []ldapGroup
+	for _, entry := range result.Entries {
+		groups = append(groups, ldapGroup{DN: entry.DN})
+	}
+	return groups, nil
+}
+
+// Search for groups listing dn (or uid for posixGroup memberUid) as a member
+func (auth *LDAPAuth) searchGroups(conn ldapSearcher, dn string, uid string) ([]ldapGroup, error) {
+	filter := strings.NewReplacer("%dn", ldap.EscapeFilter(dn), "%uid", ldap.EscapeFilter(uid)).Replace(auth.GroupSearchFilter)
+	return auth.findGroups(conn, filter)
+}
+
+// Search for groups listing the group dn as a member
+func (auth *LDAPAuth) searchParentGroups(conn ldapSearcher, dn string) ([]ldapGroup, error) {
+	filter := auth.GroupParentFilter
+	if len(filter) == 0 {
+		filter = GROUP_PARENT_SEARCH_FILTER
+	}
+	return auth.findGroups(conn, strings.ReplaceAll(filter, "%dn", ldap.EscapeFilter(dn)))
+}
+
+func (auth *LDAPAuth) findGroups(conn ldapSearcher, filter string) ([]ldapGroup, error) {
+	baseDN := auth.GroupSearchBaseDN
+	if len(baseDN) == 0 {
+		baseDN = auth.BaseDN
+	}
+	searchReq := ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, 0, 0, 0, false, filter, []string{auth.GroupNameAttribute}, []ldap.Control{})
+	result, err := conn.Search(searchReq)
+	if err != nil {
+		return nil, err
+	}
+	var groups []ldapGroup
+	for _, entry := range result.Entries {
+		groups = append(groups, ldapGroup{DN: entry.DN, Name: entry.GetAttributeValue(auth.GroupNameAttribute)})
+	}
+	return groups, nil
+}
+
+// Groups the group is a member of, using the configured membership mode
+func (auth *LDAPAuth) parentGroups(conn ldapSearcher, group ldapGroup) ([]ldapGroup, error) {
+	if auth.GroupMembership == GROUP_MEMBERSHIP_SEARCH {
+		return auth.searchParentGroups(conn, group.DN)
+	}
+	parents, err := auth.readMemberOf(conn, group.DN)
+	return groupsFromDNs(parents), err
+}
+
+// Follow group memberships breadth first, skipping groups already seen and stopping at the depth limit
+func (auth *LDAPAuth) walkGroups(conn ldapSearcher, direct []ldapGroup) ([]ldapGroup, error) {
+	depthLimit := auth.NestedGroupsDepth
+	if depthLimit <= 0 {
+		depthLimit = NESTED_GROUPS_DEPTH
+	}
+	visited := make(map[string]bool)
+	var groups []ldapGroup
+	current := direct
+	for depth := 0; len(current) > 0; depth++ {
+		if depth >= depthLimit {
+			log.Printf("@I Nested group depth limit %v reached, ignoring %v groups\n", depthLimit, len(current))
+			break
+		}
+		var next []ldapGroup
+		for _, group := range current {
+			key := normalizeDN(group.DN)
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			groups = append(groups, group)
+			parents, err := auth.parentGroups(conn, group)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, parents...)
+		}
+		current = next
+	}
+	return groups, nil
+}
+
+func (auth *LDAPAuth) readMemberOf(conn ldapSearcher, dn string) ([]string, error) {
+	searchReq := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, 0, 0, 0, false, "(objectClass=*)", []string{"memberOf"}, []ldap.Control{})
+	result, err := conn.Search(searchReq)
+	if err != nil {
+		// Groups outside our view are not an error, just the end of the chain
+		if ldap.IsErrorAnyOf(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(result.Entries) < 1 {
+		return nil, nil
+	}
+	return result.Entries[0].GetAttributeValues("memberOf"), nil
+}
+
+// Value of the first RDN if it is a CN, using real DN parsing so escaped commas work
+func commonNameFromDN(dn string) (string, bool) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return "", false
+	}
+	for _, attribute := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attribute.Type, "cn") {
+			return attribute.Value, true
+		}
+	}
+	return "", false
+}
+
+// Compare DNs without caring about case and spacing
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	var rdns []string
+	for _, rdn := range parsed.RDNs {
+		var attributes []string
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+func containsGroup(groups []ldapGroup, dn string) bool {
+	key := normalizeDN(dn)
+	for _, group := range groups {
+		if normalizeDN(group.DN) == key {
+			return true
+		}
+	}
+	return false
+}
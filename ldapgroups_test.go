@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	ldap "github.com/go-ldap/ldap/v3"
+)
+
+// Answers searches from a map of filter (or base DN for base object searches) to entries
+type fakeSearcher struct {
+	results map[string][]*ldap.Entry
+}
+
+func (fake *fakeSearcher) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	key := searchRequest.Filter
+	if searchRequest.Scope == ldap.ScopeBaseObject {
+		key = searchRequest.BaseDN
+	}
+	return &ldap.SearchResult{Entries: fake.results[key]}, nil
+}
+
+func groupEntry(name string) *ldap.Entry {
+	return ldap.NewEntry("cn="+name+",ou=groups,dc=example,dc=com", map[string][]string{"cn": {name}})
+}
+
+func groupNames(groups []ldapGroup) []string {
+	var names []string
+	for _, group := range groups {
+		names = append(names, group.Name)
+	}
+	return names
+}
+
+func Test_LdapSearchGroups(t *testing.T) {
+	auth := &LDAPAuth{LDAPConfig: LDAPConfig{
+		BaseDN:             "dc=example,dc=com",
+		NestedGroups:       NESTED_GROUPS_WALK,
+		GroupMembership:    GROUP_MEMBERSHIP_SEARCH,
+		GroupSearchFilter:  GROUP_SEARCH_FILTER,
+		GroupParentFilter:  GROUP_PARENT_SEARCH_FILTER,
+		GroupNameAttribute: "cn",
+	}}
+	user := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", nil)
+	fake := &fakeSearcher{results: map[string][]*ldap.Entry{
+		// alice is in developers, developers is in staff
+		"(|(member=uid=alice,ou=people,dc=example,dc=com)(uniqueMember=uid=alice,ou=people,dc=example,dc=com)(memberUid=alice))": {groupEntry("developers")},
+		"(|(member=cn=developers,ou=groups,dc=example,dc=com)(uniqueMember=cn=developers,ou=groups,dc=example,dc=com))":          {groupEntry("staff")},
+		// The posixGroup admins has the user developers as memberUid, matched if the group name is used as a username
+		"(|(member=cn=developers,ou=groups,dc=example,dc=com)(uniqueMember=cn=developers,ou=groups,dc=example,dc=com)(memberUid=developers))": {groupEntry("admins")},
+	}}
+	t.Run("Nested Search", func(t *testing.T) {
+		groups, err := auth.resolveGroups(fake, user, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"developers", "staff"}
+		if names := groupNames(groups); !slices.Equal(names, expected) {
+			t.Errorf("Error: %v != %v", names, expected)
+		}
+	})
+	t.Run("User Named Like Group", func(t *testing.T) {
+		groups, err := auth.resolveGroups(fake, user, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(groupNames(groups), "admins") {
+			t.Errorf("Error: group developers got the memberships of user developers: %v", groupNames(groups))
+		}
+	})
+	t.Run("Default Parent Filter", func(t *testing.T) {
+		defaults := &LDAPAuth{LDAPConfig: auth.LDAPConfig}
+		defaults.GroupParentFilter = ""
+		groups, err := defaults.parentGroups(fake, ldapGroup{DN: "cn=developers,ou=groups,dc=example,dc=com", Name: "developers"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := groupNames(groups); !slices.Equal(names, []string{"staff"}) {
+			t.Errorf("Error: %v", names)
+		}
+	})
+}
+
+func groupDNs(groups []ldapGroup) []string {
+	var dns []string
+	for _, group := range groups {
+		dns = append(dns, group.DN)
+	}
+	return dns
+}
+
+// Group entry read by DN in memberOf mode
+func memberOfEntry(dn string, memberOf ...string) *ldap.Entry {
+	return ldap.NewEntry(dn, map[string][]string{"memberOf": memberOf})
+}
+
+func Test_LdapNestedGroups(t *testing.T) {
+	t.Run("Normalize DN", func(t *testing.T) {
+		for dn, expected := range map[string]string{
+			"CN=Developers, OU=Groups,DC=Example,DC=com":   "cn=developers,ou=groups,dc=example,dc=com",
+			"cn=developers,ou=groups,dc=example,dc=com":    "cn=developers,ou=groups,dc=example,dc=com",
+			"cn=Smith\\, John,ou=people,dc=example,dc=com": "cn=smith, john,ou=people,dc=example,dc=com",
+			"cn=a+uid=B,dc=example,dc=com":                 "cn=a+uid=b,dc=example,dc=com",
+			"not a dn":                                     "not a dn",
+		} {
+			if normalized := normalizeDN(dn); normalized != expected {
+				t.Errorf("Error: %v != %v", normalized, expected)
+			}
+		}
+	})
+	t.Run("User Filter", func(t *testing.T) {
+		auth := &LDAPAuth{LDAPConfig: LDAPConfig{SearchUserFilter: "(&(uid=%s)(memberOf=%s))"}}
+		groupDN := "cn=kube,ou=groups,dc=example,dc=com"
+		if filter := auth.userFilter("alice", groupDN); filter != "(&(uid=alice)(memberOf=cn=kube,ou=groups,dc=example,dc=com))" {
+			t.Errorf("Error: filter rewritten without in chain %v", filter)
+		}
+		auth.NestedGroups = NESTED_GROUPS_INCHAIN
+		expected := "(&(uid=alice)(memberOf:" + LDAP_MATCHING_RULE_IN_CHAIN + ":=cn=kube,ou=groups,dc=example,dc=com))"
+		if filter := auth.userFilter("alice", groupDN); filter != expected {
+			t.Errorf("Error: %v != %v", filter, expected)
+		}
+		if filter := auth.userFilter("*)(uid=*", groupDN); strings.Contains(filter, "(uid=*") {
+			t.Errorf("Error: username not escaped %v", filter)
+		}
+	})
+	auth := &LDAPAuth{LDAPConfig: LDAPConfig{NestedGroups: NESTED_GROUPS_WALK, GroupMembership: GROUP_MEMBERSHIP_MEMBEROF}}
+	t.Run("Cycle", func(t *testing.T) {
+		// developers is in staff, staff is in developers written with other case and spacing
+		fake := &fakeSearcher{results: map[string][]*ldap.Entry{
+			"cn=developers,ou=groups,dc=example,dc=com":  {memberOfEntry("cn=developers,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com")},
+			"cn=staff,ou=groups,dc=example,dc=com":       {memberOfEntry("cn=staff,ou=groups,dc=example,dc=com", "CN=Developers, OU=Groups,DC=example,DC=com")},
+			"CN=Developers, OU=Groups,DC=example,DC=com": {memberOfEntry("CN=Developers, OU=Groups,DC=example,DC=com", "cn=staff,ou=groups,dc=example,dc=com")},
+		}}
+		groups, err := auth.walkGroups(fake, groupsFromDNs([]string{"cn=developers,ou=groups,dc=example,dc=com"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"cn=developers,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"}
+		if dns := groupDNs(groups); !slices.Equal(dns, expected) {
+			t.Errorf("Error: %v != %v", dns, expected)
+		}
+	})
+	t.Run("Depth Limit", func(t *testing.T) {
+		// g0 is in g1 is in g2 ... is in g5
+		fake := &fakeSearcher{results: map[string][]*ldap.Entry{}}
+		var chain []string
+		for i := 0; i <= 5; i++ {
+			chain = append(chain, fmt.Sprintf("cn=g%v,ou=groups,dc=example,dc=com", i))
+		}
+		for i := 0; i < 5; i++ {
+			fake.results[chain[i]] = []*ldap.Entry{memberOfEntry(chain[i], chain[i+1])}
+		}
+		limited := &LDAPAuth{LDAPConfig: auth.LDAPConfig}
+		limited.NestedGroupsDepth = 3
+		groups, err := limited.walkGroups(fake, groupsFromDNs(chain[:1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dns := groupDNs(groups); !slices.Equal(dns, chain[:3]) {
+			t.Errorf("Error: %v != %v", dns, chain[:3])
+		}
+		// Unset depth uses the default limit, deeper than the chain
+		groups, err = auth.walkGroups(fake, groupsFromDNs(chain[:1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dns := groupDNs(groups); !slices.Equal(dns, chain) {
+			t.Errorf("Error: default depth %v stopped early: %v", NESTED_GROUPS_DEPTH, dns)
+		}
+	})
+}
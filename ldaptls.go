@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Good documentation:
+// https://pkg.go.dev/github.com/go-ldap/ldap/v3#Conn.StartTLS
+// https://ldapwiki.com/wiki/Wiki.jsp?page=SASL%20EXTERNAL
+
+const (
+	LDAP_BIND_SIMPLE   = "simple"
+	LDAP_BIND_EXTERNAL = "external"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS version from 1.0, 1.1, 1.2 or 1.3, 0 for the Go default
+func parseTLSVersion(version string) (uint16, error) {
+	if len(version) == 0 {
+		return 0, nil
+	}
+	parsed, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %v", version)
+	}
+	return parsed, nil
+}
+
+// Inline PEM or a path to a PEM file
+func loadPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+func (auth *LDAPAuth) hasTLSSettings() bool {
+	return len(auth.CACertificate) > 0 || len(auth.ClientCertificate) > 0 || len(auth.TLSMinVersion) > 0 || len(auth.LDAPConfig.ServerName) > 0
+}
+
+func (auth *LDAPAuth) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{ServerName: auth.LDAPConfig.ServerName}
+	var err error
+	config.MinVersion, err = parseTLSVersion(auth.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(auth.CACertificate) > 0 {
+		cert, err := loadPEM(auth.CACertificate)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("no certificates found in LDAP CACertificate")
+		}
+		config.RootCAs = caCertPool
+	}
+	if len(auth.ClientCertificate) > 0 || len(auth.ClientKey) > 0 {
+		certPEM, err := loadPEM(auth.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := loadPEM(auth.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Hostname of an ldap:// URL, used as server name for StartTLS
+func ldapHostname(ldapURL string) string {
+	parsed, err := url.Parse(ldapURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
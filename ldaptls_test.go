@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_LdapTLS(t *testing.T) {
+	t.Run("TLS Version", func(t *testing.T) {
+		for version, expected := range map[string]uint16{"": 0, "1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13} {
+			parsed, err := parseTLSVersion(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed != expected {
+				t.Errorf("Error: %v: %v != %v", version, parsed, expected)
+			}
+		}
+		if _, err := parseTLSVersion("2.0"); err == nil {
+			t.Errorf("Error: unknown version accepted")
+		}
+	})
+	t.Run("CA From File Or Inline", func(t *testing.T) {
+		cert := testCA(t, "ldap-test-ca")
+		ca := []byte(cert.GetPEMCert())
+		path := filepath.Join(t.TempDir(), "ca.crt")
+		if err := os.WriteFile(path, ca, 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []string{string(ca), path} {
+			auth := &LDAPAuth{LDAPConfig: LDAPConfig{CACertificate: value, TLSMinVersion: "1.2", ServerName: "ldap.example.com"}}
+			config, err := auth.tlsConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.RootCAs == nil || config.MinVersion != tls.VersionTLS12 || config.ServerName != "ldap.example.com" {
+				t.Errorf("Error: unexpected config %+v", config)
+			}
+		}
+	})
+	t.Run("Hostname", func(t *testing.T) {
+		if host := ldapHostname("ldap://ldap.example.com:389"); host != "ldap.example.com" {
+			t.Errorf("Error: %v != ldap.example.com", host)
+		}
+	})
+}
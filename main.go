@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -21,11 +22,19 @@ const (
 // https://kubernetes.io/docs/reference/access-authn-authz/certificate-signing-requests/
 
 type MainConfig struct {
-	LDAP          LDAPConfig
-	Kubernetes    KubernetesConfig
-	Proxy         ProxyConfig
-	Verbose       bool
-	Impersonation bool
+	LDAP                LDAPConfig
+	Kubernetes          KubernetesConfig
+	Proxy               ProxyConfig
+	Throttle            ThrottleConfig
+	RateLimits          RateLimitConfig
+	GroupMapping        GroupMappingConfig
+	HeaderPolicy        HeaderPolicyConfig
+	Identity            IdentityConfig
+	Clusters            []ClusterConfig
+	NestedImpersonation []NestedImpersonationConfig
+	Verbose             bool
+	Impersonation       bool
+	Mode                string
 }
 type ProxyConfig struct {
 	Port string
@@ -33,8 +42,30 @@ type ProxyConfig struct {
 	TLS  TLSConfig
 }
 type TLSConfig struct {
-	Certificate string
-	Key         string
+	Certificate    string
+	Key            string
+	CACertificate  string
+	ReloadInterval time.Duration
+	SNI            []SNICertificateConfig
+	SelfSigned     SelfSignedConfig
+	ClientAuth     ClientAuthConfig
+}
+type SNICertificateConfig struct {
+	Hosts         []string
+	Certificate   string
+	Key           string
+	CACertificate string
+}
+type SelfSignedConfig struct {
+	Enabled    bool
+	SecretName string
+	Hosts      []string
+	Validity   time.Duration
+	CAValidity time.Duration
+}
+type ClientAuthConfig struct {
+	CA               string
+	RequireLDAPGroup bool
 }
 type LDAPConfig struct {
 	URL                 string
@@ -47,11 +78,140 @@ type LDAPConfig struct {
 	SearchGroupFilter   string
 	MembershipAtributes string
 	CACertificate       string
+	ClientCertificate   string
+	ClientKey           string
+	StartTLS            bool
+	TLSMinVersion       string
+	ServerName          string
+	BindMethod          string
+	SearchLoginFilter   string
+	UsernameAttribute   string
+	Schema              string
+	NestedGroups        string
+	NestedGroupsDepth   int
+	GroupMembership     string
+	GroupSearchFilter   string
+	GroupParentFilter   string
+	GroupSearchBaseDN   string
+	GroupNameAttribute  string
+	AccessGroups        []AccessGroupConfig
+	UIDAttribute        string
+	ExtraAttributes     []ExtraAttributeConfig
+}
+type ExtraAttributeConfig struct {
+	Attribute string
+	Key       string
+}
+type AccessGroupConfig struct {
+	Name                string
+	Mode                string
+	CertificateLifetime time.Duration
+	RateLimit           RateLimit
+	KubernetesGroups    []string
+}
+type ThrottleConfig struct {
+	Enabled           bool
+	MaxFailures       int
+	Window            time.Duration
+	LockoutDuration   time.Duration
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	TrustForwardedFor bool
+	PerClientIP       bool
+	Store             string
+	StoreName         string
+}
+type RateLimitConfig struct {
+	Enabled bool
+	Default RateLimit
+	Users   []NamedRateLimit
+	Groups  []NamedRateLimit
+}
+type NamedRateLimit struct {
+	Name      string
+	RateLimit `mapstructure:",squash"`
+}
+type NestedImpersonationConfig struct {
+	LDAPGroups []string
+	Users      []string
+	Groups     []string
+}
+type IdentityConfig struct {
+	UsernamePrefix string
+	GroupPrefix    string
+}
+type HeaderPolicyConfig struct {
+	Deny []string
+}
+type GroupMappingConfig struct {
+	Include []string
+	Exclude []string
+	Rename  []GroupRenameConfig
+	Prefix  string
+	Static  []StaticGroupsConfig
+}
+type GroupRenameConfig struct {
+	From string
+	To   string
+}
+type StaticGroupsConfig struct {
+	Users  []string
+	Groups []string
 }
 type KubernetesConfig struct {
-	KubeConfig string
-	Namespace  string
-	Host       string
+	KubeConfig          string
+	Namespace           string
+	Server              string
+	Host                string
+	Hosts               []string
+	TLSServerName       string
+	TLSMinVersion       string
+	CertificatePins     []string
+	ProxyURL            string
+	FrontProxy          FrontProxyConfig
+	ServiceAccounts     ServiceAccountConfig
+	Signer              SignerConfig
+	Key                 KeyConfig
+	Balancing           string
+	HealthCheckInterval time.Duration
+}
+type FrontProxyConfig struct {
+	Certificate       string
+	Key               string
+	UsernameHeader    string
+	GroupHeader       string
+	UIDHeader         string
+	ExtraHeaderPrefix string
+}
+type KeyConfig struct {
+	Algorithm string
+	Size      int
+}
+type SignerConfig struct {
+	Type                   string
+	CACertificate          string
+	CAKey                  string
+	SignerName             string
+	Approval               string
+	ExternalApprovalGroups []string
+	ApprovalTimeout        time.Duration
+}
+type ServiceAccountConfig struct {
+	TokenLifetime time.Duration
+	SyncInterval  time.Duration
+	Bindings      []ServiceAccountBindingConfig
+}
+type ServiceAccountBindingConfig struct {
+	Group       string
+	ClusterRole string
+	Namespace   string
+}
+type ClusterConfig struct {
+	Name             string
+	KubernetesConfig `mapstructure:",squash"`
+	Hostnames        []string
+	Mode             string
+	AllowedGroups    []string
 }
 
 // Setting defaults for configuration if no file exists.
@@ -63,16 +223,45 @@ func LoadConfig() MainConfig {
 	viper.SetDefault("Impersonation", true)
 	viper.SetDefault("Proxy.Host", "")
 	viper.SetDefault("Proxy.Port", "8080")
+	viper.SetDefault("Proxy.TLS.ReloadInterval", CERTIFICATE_RELOAD_INTERVAL)
+	viper.SetDefault("Proxy.TLS.SelfSigned.Enabled", false)
+	viper.SetDefault("Proxy.TLS.SelfSigned.SecretName", SELF_SIGNED_SECRET_NAME)
+	viper.SetDefault("Proxy.TLS.SelfSigned.Validity", SELF_SIGNED_VALIDITY)
+	viper.SetDefault("Proxy.TLS.SelfSigned.CAValidity", SELF_SIGNED_CA_VALIDITY)
+	viper.SetDefault("Throttle.Enabled", true)
+	viper.SetDefault("Throttle.MaxFailures", 10)
+	viper.SetDefault("Throttle.Window", 15*time.Minute)
+	viper.SetDefault("Throttle.LockoutDuration", 15*time.Minute)
+	viper.SetDefault("Throttle.BaseDelay", time.Second)
+	viper.SetDefault("Throttle.MaxDelay", 30*time.Second)
+	viper.SetDefault("Throttle.TrustForwardedFor", false)
+	viper.SetDefault("Throttle.PerClientIP", false)
+	viper.SetDefault("Throttle.Store", THROTTLE_STORE_MEMORY)
+	viper.SetDefault("Throttle.StoreName", THROTTLE_STORE_NAME)
+	viper.SetDefault("RateLimits.Enabled", false)
 	viper.SetDefault("Kubernetes.KubeConfig", "")
 	viper.SetDefault("Kubernetes.Namespace", "kube-auth-proxy")
-	viper.SetDefault("Kubernetes.Host", "kubernetes.default")
+	viper.SetDefault("Kubernetes.Balancing", BALANCING_ROUND_ROBIN)
+	viper.SetDefault("Kubernetes.HealthCheckInterval", HEALTH_CHECK_INTERVAL)
 	viper.SetDefault("LDAP.SearchUserFilter", "(&(uid=%s)(memberOf=%s))")
 	viper.SetDefault("LDAP.SearchGroupFilter", "(&(cn=%s)(objectClass=groupOfNames))")
+	viper.SetDefault("LDAP.SearchLoginFilter", "(uid=%s)")
+	viper.SetDefault("LDAP.UsernameAttribute", "uid")
+	viper.SetDefault("LDAP.NestedGroups", NESTED_GROUPS_NONE)
+	viper.SetDefault("LDAP.NestedGroupsDepth", NESTED_GROUPS_DEPTH)
+	viper.SetDefault("LDAP.GroupMembership", GROUP_MEMBERSHIP_MEMBEROF)
+	viper.SetDefault("LDAP.GroupSearchFilter", GROUP_SEARCH_FILTER)
+	viper.SetDefault("LDAP.GroupParentFilter", GROUP_PARENT_SEARCH_FILTER)
+	viper.SetDefault("LDAP.GroupNameAttribute", "cn")
+	viper.SetDefault("LDAP.BindMethod", LDAP_BIND_SIMPLE)
 	viper.BindEnv("LDAP.BindPassword", "LDAP_BIND_PASSWORD")
 	err := viper.ReadInConfig() // Find and read the config file
 	if err != nil {             // Handle errors reading the config file
 		panic(fmt.Errorf("fatal error config file: %w", err))
 	}
+	if viper.GetString("LDAP.Schema") == LDAP_SCHEMA_ACTIVEDIRECTORY {
+		setActiveDirectoryDefaults()
+	}
 	var Config MainConfig
 	viper.Unmarshal(&Config)
 	return Config
@@ -84,14 +273,39 @@ func main() {
 	// Create KubeClient Object
 	client, err := NewKubeClient(Config.Kubernetes)
 	if err != nil {
-		log.Printf("Error creating kubeconfig : %+v\n", err)
-		return
+		log.Fatalf("@F Error creating kubeconfig : %+v\n", err)
 	}
 	// Start up the proxy.
 	// Setup and start the Proxy
-	proxy := &Proxy{LDAPAuth: LDAP, KubeClient: client, Config: &Config}
-	if !Config.Impersonation {
-		proxy.certificaeStorage = NewCertificateStorage(client)
+	proxy := &Proxy{LDAPAuth: LDAP, KubeClient: client, Config: &Config, headerPolicy: NewHeaderPolicy(Config.HeaderPolicy)}
+	proxy.groupMapping, err = NewGroupMapping(Config.GroupMapping, Config.Identity)
+	if err != nil {
+		log.Fatalf("@F Error in group mapping : %+v\n", err)
+	}
+	proxy.nestedImpersonation, err = NewNestedImpersonation(Config.NestedImpersonation)
+	if err != nil {
+		log.Fatalf("@F Error in nested impersonation : %+v\n", err)
+	}
+	err = Config.validateAccessGroups()
+	if err != nil {
+		log.Fatalf("@F Error in access groups : %+v\n", err)
+	}
+	proxy.clusters, err = NewClusters(&Config, client)
+	if err != nil {
+		log.Fatalf("@F Error in clusters : %+v\n", err)
+	}
+	proxy.startServiceAccountSync()
+	if Config.RateLimits.Enabled || Config.hasAccessGroupRateLimits() {
+		proxy.rateLimiter = NewRateLimiter(Config.RateLimits, Config.LDAP.AccessGroups)
+	}
+	if Config.Throttle.Enabled {
+		proxy.loginThrottle, err = NewLoginThrottle(Config.Throttle, client)
+		if err != nil {
+			log.Fatalf("@F Error creating login throttle : %+v\n", err)
+		}
+	}
+	err = proxy.StartProxy(Config.Proxy)
+	if err != nil {
+		log.Fatalf("@F Error starting proxy : %+v\n", err)
 	}
-	proxy.StartProxy(Config.Proxy)
 }
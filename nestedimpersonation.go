@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
+// https://kubernetes.io/docs/reference/config-api/apiserver-audit.v1/#audit-k8s-io-v1-Event
+
+// Extra key recording the LDAP user behind an impersonated request
+const EXTRA_IMPERSONATED_BY = "auth.stiil.dk/impersonated-by"
+
+// User and groups requested with kubectl --as and --as-group
+type ImpersonationTarget struct {
+	User   string
+	Groups []string
+}
+
+type nestedImpersonationRule struct {
+	groups []string
+	users  []*regexp.Regexp
+	// Kubernetes groups that may be impersonated
+	targetGroups []*regexp.Regexp
+}
+
+// Decides which LDAP users may impersonate whom
+type NestedImpersonation struct {
+	rules []nestedImpersonationRule
+}
+
+func compileGroupPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var expressions []*regexp.Regexp
+	for _, pattern := range patterns {
+		expression, err := compileGroupPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, nil
+}
+
+func NewNestedImpersonation(config []NestedImpersonationConfig) (*NestedImpersonation, error) {
+	nested := &NestedImpersonation{}
+	for _, ruleConfig := range config {
+		rule := nestedImpersonationRule{groups: ruleConfig.LDAPGroups}
+		var err error
+		rule.users, err = compileGroupPatterns(ruleConfig.Users)
+		if err != nil {
+			return nil, err
+		}
+		rule.targetGroups, err = compileGroupPatterns(ruleConfig.Groups)
+		if err != nil {
+			return nil, err
+		}
+		nested.rules = append(nested.rules, rule)
+	}
+	return nested, nil
+}
+
+// Impersonation requested by the client, nil if none
+func requestedImpersonation(r *http.Request) *ImpersonationTarget {
+	user := r.Header.Get("Impersonate-User")
+	groups := r.Header.Values("Impersonate-Group")
+	if len(user) == 0 && len(groups) == 0 {
+		return nil
+	}
+	return &ImpersonationTarget{User: user, Groups: groups}
+}
+
+func (rule *nestedImpersonationRule) appliesTo(user *LDAPUser) bool {
+	return slices.ContainsFunc(rule.groups, func(group string) bool {
+		return slices.Contains(user.LDAPGroups, group) || slices.Contains(user.AccessGroups, group)
+	})
+}
+
+func (rule *nestedImpersonationRule) allows(target *ImpersonationTarget) bool {
+	if !matchesAny(rule.users, target.User) {
+		return false
+	}
+	for _, group := range target.Groups {
+		if !matchesAny(rule.targetGroups, group) {
+			return false
+		}
+	}
+	return true
+}
+
+// Error if no rule lets user impersonate target
+func (nested *NestedImpersonation) Authorize(user *LDAPUser, target *ImpersonationTarget) error {
+	if len(target.User) == 0 {
+		return fmt.Errorf("impersonating groups requires impersonating a user")
+	}
+	// System users, service accounts and groups like system:masters are never impersonated
+	if isReservedIdentity(target.User) {
+		return fmt.Errorf("user %v is reserved", target.User)
+	}
+	for _, group := range target.Groups {
+		if isReservedIdentity(group) {
+			return fmt.Errorf("group %v is reserved", group)
+		}
+	}
+	for _, rule := range nested.rules {
+		if rule.appliesTo(user) && rule.allows(target) {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %v may not impersonate %v with groups %v", user.User, target.User, target.Groups)
+}
+
+// Impersonation headers for a nested impersonation in impersonation mode.
+// The real user is kept as extra so the audit log shows both.
+func setNestedImpersonation(header http.Header, user *LDAPUser) {
+	header["Impersonate-User"] = []string{user.Target.User}
+	header["Impersonate-Group"] = user.Target.Groups
+	header[impersonateExtraHeader(EXTRA_IMPERSONATED_BY)] = []string{user.User}
+}
+
+// In certificate and front-proxy mode the request is forwarded as the real user asking Kubernetes to impersonate
+func setCertificateImpersonation(header http.Header, user *LDAPUser) {
+	header["Impersonate-User"] = []string{user.Target.User}
+	if len(user.Target.Groups) > 0 {
+		header["Impersonate-Group"] = user.Target.Groups
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func Test_NestedImpersonation(t *testing.T) {
+	nested, err := NewNestedImpersonation([]NestedImpersonationConfig{
+		{LDAPGroups: []string{"sre"}, Users: []string{".*"}, Groups: []string{"team-.*"}},
+		{LDAPGroups: []string{"developers"}, Users: []string{"ci-.*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sre := &LDAPUser{User: "alice", LDAPGroups: []string{"sre"}}
+	developer := &LDAPUser{User: "bob", LDAPGroups: []string{"developers"}}
+	t.Run("Allowed", func(t *testing.T) {
+		for _, test := range []struct {
+			user   *LDAPUser
+			target *ImpersonationTarget
+		}{
+			{sre, &ImpersonationTarget{User: "carol"}},
+			{sre, &ImpersonationTarget{User: "carol", Groups: []string{"team-a"}}},
+			{developer, &ImpersonationTarget{User: "ci-deploy"}},
+		} {
+			if err := nested.Authorize(test.user, test.target); err != nil {
+				t.Errorf("Error: %v", err)
+			}
+		}
+	})
+	t.Run("Denied", func(t *testing.T) {
+		for _, test := range []struct {
+			user   *LDAPUser
+			target *ImpersonationTarget
+		}{
+			{sre, &ImpersonationTarget{User: "carol", Groups: []string{"system:masters"}}},
+			{sre, &ImpersonationTarget{Groups: []string{"team-a"}}},
+			{developer, &ImpersonationTarget{User: "carol"}},
+			{developer, &ImpersonationTarget{User: "ci-deploy", Groups: []string{"team-a"}}},
+			{&LDAPUser{User: "dave"}, &ImpersonationTarget{User: "carol"}},
+		} {
+			if err := nested.Authorize(test.user, test.target); err == nil {
+				t.Errorf("Error: %v allowed to impersonate %+v", test.user.User, test.target)
+			}
+		}
+	})
+	t.Run("Reserved", func(t *testing.T) {
+		permissive, err := NewNestedImpersonation([]NestedImpersonationConfig{
+			{LDAPGroups: []string{"sre"}, Users: []string{".*"}, Groups: []string{".*"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := permissive.Authorize(sre, &ImpersonationTarget{User: "carol", Groups: []string{"team-a"}}); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		for _, target := range []*ImpersonationTarget{
+			{User: "system:admin"},
+			{User: "System:Kube-Controller-Manager"},
+			{User: "system:serviceaccount:kube-system:default"},
+			{User: "carol", Groups: []string{"system:masters"}},
+			{User: "carol", Groups: []string{"team-a", "system:nodes"}},
+		} {
+			if err := permissive.Authorize(sre, target); err == nil {
+				t.Errorf("Error: reserved identity %+v allowed", target)
+			}
+		}
+	})
+	t.Run("Headers", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+		request.Header.Set("Impersonate-User", "carol")
+		request.Header.Add("Impersonate-Group", "team-a")
+		user := &LDAPUser{User: "alice", Groups: []string{"sre"}, Target: requestedImpersonation(request)}
+		header := NewHeaderPolicy(HeaderPolicyConfig{}).Filter(request.Header)
+		setNestedImpersonation(header, user)
+		if !slices.Equal(header["Impersonate-User"], []string{"carol"}) || !slices.Equal(header["Impersonate-Group"], []string{"team-a"}) {
+			t.Errorf("Error: wrong target %v", header)
+		}
+		if by := header["Impersonate-Extra-auth.stiil.dk%2Fimpersonated-by"]; !slices.Equal(by, []string{"alice"}) {
+			t.Errorf("Error: real user not recorded %v", header)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Good documentation:
+// https://pkg.go.dev/golang.org/x/time/rate
+// https://kubernetes.io/docs/concepts/cluster-administration/flow-control/
+
+// Limits for requests toward the API server, zero values are unlimited
+type RateLimit struct {
+	QPS            float64
+	Burst          int
+	MaxInFlight    int
+	MaxLongRunning int
+}
+
+// Token bucket and in flight counters for one user or group
+type rateLimitBucket struct {
+	name        string
+	limit       RateLimit
+	limiter     *rate.Limiter
+	inFlight    int
+	longRunning int
+	lastUsed    time.Time
+}
+
+type RateLimiter struct {
+	config  RateLimitConfig
+	mutex   sync.Mutex
+	buckets map[string]*rateLimitBucket
+}
+
+const (
+	RATE_LIMIT_KEY_USER  = "user:"
+	RATE_LIMIT_KEY_GROUP = "group:"
+	// Buckets unused for this long are removed
+	RATE_LIMIT_IDLE_TIMEOUT = time.Minute * 10
+)
+
+// Subresources that keep the connection open
+var longRunningSubresources = map[string]bool{
+	"exec":        true,
+	"attach":      true,
+	"portforward": true,
+	"proxy":       true,
+}
+
+func NewRateLimiter(config RateLimitConfig, accessGroups []AccessGroupConfig) *RateLimiter {
+	// Access group limits are group limits for the members of the access group
+	for _, accessGroup := range accessGroups {
+		if accessGroup.RateLimit != (RateLimit{}) {
+			config.Groups = append(config.Groups, NamedRateLimit{Name: accessGroup.Name, RateLimit: accessGroup.RateLimit})
+		}
+	}
+	limiter := &RateLimiter{config: config, buckets: make(map[string]*rateLimitBucket)}
+	go limiter.cleanupTask()
+	return limiter
+}
+
+// Watches, exec, attach, port-forward, proxy and followed logs
+func isLongRunning(r *http.Request) bool {
+	query := r.URL.Query()
+	if watch := query.Get("watch"); watch == "true" || watch == "1" {
+		return true
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// /api/v1/... or /apis/group/version/...
+	base := 2
+	if parts[0] == "apis" {
+		base = 3
+	}
+	if len(parts) <= base {
+		return false
+	}
+	if parts[base] == "watch" {
+		return true
+	}
+	rest := parts[base:]
+	if rest[0] == "namespaces" && len(rest) > 2 {
+		rest = rest[2:]
+	}
+	// resource/name/subresource
+	if len(rest) < 3 {
+		return false
+	}
+	if rest[2] == "log" {
+		return query.Get("follow") == "true"
+	}
+	return longRunningSubresources[rest[2]]
+}
+
+func (limiter *RateLimiter) userLimit(username string) RateLimit {
+	for _, rule := range limiter.config.Users {
+		if rule.Name == username {
+			return rule.RateLimit
+		}
+	}
+	return limiter.config.Default
+}
+
+func (limiter *RateLimiter) groupLimits(groups ...[]string) map[string]RateLimit {
+	limits := make(map[string]RateLimit)
+	for _, group := range slices.Concat(groups...) {
+		for _, rule := range limiter.config.Groups {
+			if rule.Name == group {
+				limits[group] = rule.RateLimit
+			}
+		}
+	}
+	return limits
+}
+
+func (limiter *RateLimiter) bucket(key string, name string, limit RateLimit) *rateLimitBucket {
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{name: name, limit: limit}
+		if limit.QPS > 0 {
+			burst := limit.Burst
+			if burst < 1 {
+				burst = int(math.Ceil(limit.QPS))
+			}
+			bucket.limiter = rate.NewLimiter(rate.Limit(limit.QPS), burst)
+		}
+		limiter.buckets[key] = bucket
+	}
+	bucket.lastUsed = time.Now()
+	return bucket
+}
+
+// Take a slot for a request for user in all buckets that apply.
+// Returns a release function, or an error and how long to wait before retrying.
+func (limiter *RateLimiter) Acquire(user *LDAPUser, longRunning bool) (func(), time.Duration, error) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	buckets := []*rateLimitBucket{limiter.bucket(RATE_LIMIT_KEY_USER+user.User, "user "+user.User, limiter.userLimit(user.User))}
+	for group, limit := range limiter.groupLimits(user.LDAPGroups, user.AccessGroups) {
+		buckets = append(buckets, limiter.bucket(RATE_LIMIT_KEY_GROUP+group, "group "+group, limit))
+	}
+	// Check everything before taking anything, so a rejected request costs nothing
+	reservations := []*rate.Reservation{}
+	cancel := func() {
+		for _, reservation := range reservations {
+			reservation.Cancel()
+		}
+	}
+	for _, bucket := range buckets {
+		if longRunning {
+			if bucket.limit.MaxLongRunning > 0 && bucket.longRunning >= bucket.limit.MaxLongRunning {
+				return nil, time.Second, fmt.Errorf("too many long running requests for %v", bucket.name)
+			}
+			continue
+		}
+		if bucket.limit.MaxInFlight > 0 && bucket.inFlight >= bucket.limit.MaxInFlight {
+			cancel()
+			return nil, time.Second, fmt.Errorf("too many requests in flight for %v", bucket.name)
+		}
+		if bucket.limiter != nil {
+			reservation := bucket.limiter.Reserve()
+			reservations = append(reservations, reservation)
+			if delay := reservation.Delay(); delay > 0 {
+				cancel()
+				return nil, delay, fmt.Errorf("rate limit exceeded for %v", bucket.name)
+			}
+		}
+	}
+	for _, bucket := range buckets {
+		if longRunning {
+			bucket.longRunning += 1
+		} else {
+			bucket.inFlight += 1
+		}
+	}
+	return func() {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		for _, bucket := range buckets {
+			if longRunning {
+				bucket.longRunning -= 1
+			} else {
+				bucket.inFlight -= 1
+			}
+			bucket.lastUsed = time.Now()
+		}
+	}, 0, nil
+}
+
+func (limiter *RateLimiter) cleanupTask() {
+	ticker := time.NewTicker(5 * time.Minute)
+	for range ticker.C {
+		var count, deleted uint32
+		limiter.mutex.Lock()
+		for key, bucket := range limiter.buckets {
+			count += 1
+			if bucket.inFlight == 0 && bucket.longRunning == 0 && time.Since(bucket.lastUsed) > RATE_LIMIT_IDLE_TIMEOUT {
+				deleted += 1
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.mutex.Unlock()
+		log.Printf("Cleanup of %v rate limit buckets, Removed %v idle.", count, deleted)
+	}
+}
+
+func (config *MainConfig) hasAccessGroupRateLimits() bool {
+	return slices.ContainsFunc(config.LDAP.AccessGroups, func(accessGroup AccessGroupConfig) bool {
+		return accessGroup.RateLimit != (RateLimit{})
+	})
+}
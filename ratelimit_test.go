@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_IsLongRunning(t *testing.T) {
+	for url, expected := range map[string]bool{
+		"/api/v1/namespaces/default/pods":                          false,
+		"/api/v1/namespaces/default/pods?watch=true":               true,
+		"/api/v1/watch/namespaces/default/pods":                    true,
+		"/apis/apps/v1/namespaces/default/deployments?watch=1":     true,
+		"/api/v1/namespaces/default/pods/exec":                     false,
+		"/api/v1/namespaces/default/pods/web/exec?command=sh":      true,
+		"/api/v1/namespaces/default/pods/web/portforward":          true,
+		"/api/v1/namespaces/default/pods/web/log":                  false,
+		"/api/v1/namespaces/default/pods/web/log?follow=true":      true,
+		"/api/v1/namespaces/default/services/web:80/proxy/metrics": true,
+		"/api/v1/nodes/node1/proxy":                                true,
+		"/version":                                                 false,
+	} {
+		if longRunning := isLongRunning(httptest.NewRequest("GET", url, nil)); longRunning != expected {
+			t.Errorf("Error: %v long running %v != %v", url, longRunning, expected)
+		}
+	}
+}
+
+func Test_RateLimiter(t *testing.T) {
+	limiter := &RateLimiter{config: RateLimitConfig{
+		Default: RateLimit{QPS: 1, Burst: 2, MaxInFlight: 5, MaxLongRunning: 1},
+		Groups:  []NamedRateLimit{{Name: "developers", RateLimit: RateLimit{MaxInFlight: 1}}},
+	}, buckets: make(map[string]*rateLimitBucket)}
+	alice := &LDAPUser{User: "alice"}
+	t.Run("Token Bucket", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			release, _, err := limiter.Acquire(alice, false)
+			if err != nil {
+				t.Fatalf("Error: request %v rejected: %v", i, err)
+			}
+			release()
+		}
+		_, retryAfter, err := limiter.Acquire(alice, false)
+		if err == nil || retryAfter <= 0 {
+			t.Errorf("Error: burst exceeded without rejection")
+		}
+	})
+	t.Run("Long Running Counted Separately", func(t *testing.T) {
+		release, _, err := limiter.Acquire(alice, true)
+		if err != nil {
+			t.Fatalf("Error: watch rejected: %v", err)
+		}
+		if _, _, err := limiter.Acquire(alice, true); err == nil {
+			t.Error("Error: second watch allowed over MaxLongRunning")
+		}
+		release()
+	})
+	t.Run("Group In Flight", func(t *testing.T) {
+		bob := &LDAPUser{User: "bob", LDAPGroups: []string{"developers"}}
+		carol := &LDAPUser{User: "carol", LDAPGroups: []string{"developers"}}
+		release, _, err := limiter.Acquire(bob, false)
+		if err != nil {
+			t.Fatalf("Error: request rejected: %v", err)
+		}
+		if _, _, err := limiter.Acquire(carol, false); err == nil {
+			t.Error("Error: group MaxInFlight not shared between members")
+		}
+		release()
+		if _, _, err := limiter.Acquire(carol, false); err != nil {
+			t.Errorf("Error: request rejected after release: %v", err)
+		}
+	})
+	t.Run("Access Group In Flight", func(t *testing.T) {
+		limiter := NewRateLimiter(RateLimitConfig{
+			Default: RateLimit{QPS: 1, Burst: 2, MaxInFlight: 5, MaxLongRunning: 1},
+		}, []AccessGroupConfig{{Name: "kube-admins", RateLimit: RateLimit{MaxInFlight: 1}}, {Name: "kube-users"}})
+		dave := &LDAPUser{User: "dave", AccessGroups: []string{"kube-admins"}}
+		erin := &LDAPUser{User: "erin", AccessGroups: []string{"kube-admins"}}
+		frank := &LDAPUser{User: "frank", AccessGroups: []string{"kube-users"}}
+		release, _, err := limiter.Acquire(dave, false)
+		if err != nil {
+			t.Fatalf("Error: request rejected: %v", err)
+		}
+		if _, _, err := limiter.Acquire(erin, false); err == nil {
+			t.Error("Error: access group MaxInFlight not shared between members")
+		}
+		frankRelease, _, err := limiter.Acquire(frank, false)
+		if err != nil {
+			t.Errorf("Error: access group without limits rejected: %v", err)
+		} else {
+			frankRelease()
+		}
+		release()
+	})
+}
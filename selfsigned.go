@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Serving certificate generated by the proxy itself and shared between replicas through a Secret
+type SelfSignedCertificate struct {
+	client          *KubeClient
+	config          SelfSignedConfig
+	mutex           sync.RWMutex
+	ca              *Certificate
+	certificate     *tls.Certificate
+	resourceVersion string
+}
+
+const (
+	SELF_SIGNED_CA_PATH           = "/ca.crt"
+	SELF_SIGNED_SECRET_NAME       = "kube-auth-proxy-tls"
+	SELF_SIGNED_VALIDITY          = time.Hour * 24 * 90
+	SELF_SIGNED_CA_VALIDITY       = time.Hour * 24 * 365 * 10
+	SELF_SIGNED_CHECK_INTERVAL    = time.Minute * 10
+	SELF_SIGNED_CA_COMMON_NAME    = "kube-auth-proxy-ca"
+	SECRET_KEY_CA_CERT            = "ca.crt"
+	SECRET_KEY_CA_KEY             = "ca.key"
+	SECRET_KEY_TLS_CERT           = "tls.crt"
+	SECRET_KEY_TLS_KEY            = "tls.key"
+	ANNOTATION_SELF_SIGNED_HOSTS  = "auth.stiil.dk/hosts"
+	LABLE_KEY_SELF_SIGNED_SERVING = "auth.stiil.dk/servingcertificate"
+)
+
+func NewSelfSignedCertificate(client *KubeClient, config SelfSignedConfig) (*SelfSignedCertificate, error) {
+	if len(config.SecretName) == 0 {
+		config.SecretName = SELF_SIGNED_SECRET_NAME
+	}
+	if config.Validity <= 0 {
+		config.Validity = SELF_SIGNED_VALIDITY
+	}
+	if config.CAValidity <= 0 {
+		config.CAValidity = SELF_SIGNED_CA_VALIDITY
+	}
+	if len(config.Hosts) == 0 {
+		// Names the in cluster service can be reached on
+		config.Hosts = []string{
+			"kube-auth-proxy",
+			"kube-auth-proxy." + client.namespace,
+			"kube-auth-proxy." + client.namespace + ".svc",
+			"localhost",
+			"127.0.0.1",
+		}
+	}
+	ss := &SelfSignedCertificate{client: client, config: config}
+	err := ss.ensure()
+	if err != nil {
+		return nil, err
+	}
+	go ss.renewTask()
+	return ss, nil
+}
+
+// Make sure the Secret holds a valid CA and serving certificate and that we are serving those.
+func (ss *SelfSignedCertificate) ensure() error {
+	secret, err := ss.client.GetSecret(ss.config.SecretName)
+	if apierros.IsNotFound(err) {
+		log.Printf("@I No serving certificate secret %v found, generating new CA and certificate\n", ss.config.SecretName)
+		secret, err = ss.generate(nil)
+		if err != nil {
+			return err
+		}
+		created, err := ss.client.CreateSecret(ss.config.SecretName, secret)
+		if apierros.IsAlreadyExists(err) {
+			// Another replica won the race, use theirs
+			return ss.ensure()
+		}
+		if err != nil {
+			return err
+		}
+		return ss.load(created)
+	}
+	if err != nil {
+		return err
+	}
+	ca, err := CertificateFromPEM(secret.Name, secret.Data[SECRET_KEY_CA_CERT], secret.Data[SECRET_KEY_CA_KEY])
+	if err != nil || ss.needsRenewal(ca, ss.config.CAValidity) {
+		log.Printf("@I CA in secret %v missing or about to expire, generating new CA and certificate\n", ss.config.SecretName)
+		ca = nil
+	} else {
+		serving, err := CertificateFromPEM(secret.Name, secret.Data[SECRET_KEY_TLS_CERT], secret.Data[SECRET_KEY_TLS_KEY])
+		if err == nil && !ss.needsRenewal(serving, ss.config.Validity) && secret.Annotations[ANNOTATION_SELF_SIGNED_HOSTS] == ss.hostsAnnotation() {
+			return ss.load(secret)
+		}
+		log.Printf("@I Serving certificate in secret %v about to expire or changed, renewing\n", ss.config.SecretName)
+	}
+	renewed, err := ss.generate(ca)
+	if err != nil {
+		return err
+	}
+	renewed.ObjectMeta.ResourceVersion = secret.ResourceVersion
+	updated, err := ss.client.updateSecret(ss.config.SecretName, renewed)
+	if apierros.IsConflict(err) {
+		// Renewed by another replica in the meantime
+		return ss.ensure()
+	}
+	if err != nil {
+		return err
+	}
+	return ss.load(updated)
+}
+
+// Renew when less than a third of the validity is left
+func (ss *SelfSignedCertificate) needsRenewal(cert *Certificate, validity time.Duration) bool {
+	expiration, err := cert.getCertificateNotAfterTime()
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(validity / 3).After(*expiration)
+}
+
+func (ss *SelfSignedCertificate) hostsAnnotation() string {
+	return strings.Join(ss.config.Hosts, ",")
+}
+
+// Generate a secret with a serving certificate signed by ca. A new CA is created if ca is nil
+func (ss *SelfSignedCertificate) generate(ca *Certificate) (*corev1.Secret, error) {
+	if ca == nil {
+		ca = &Certificate{name: SELF_SIGNED_CA_COMMON_NAME}
+		err := ca.createEllipticKey()
+		if err != nil {
+			return nil, err
+		}
+		err = ca.createSelfSignedCA(SELF_SIGNED_CA_COMMON_NAME, ss.config.CAValidity)
+		if err != nil {
+			return nil, err
+		}
+	}
+	serving := &Certificate{name: ss.config.SecretName}
+	err := serving.createEllipticKey()
+	if err != nil {
+		return nil, err
+	}
+	err = serving.createServingCert(ca, ss.config.Hosts, ss.config.Validity)
+	if err != nil {
+		return nil, err
+	}
+	expiration := LABLE_EXPIRATION_UNASSIGNED
+	if notAfter, err := serving.getCertificateNotAfterTime(); err == nil {
+		expiration = timeToString(notAfter)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ss.config.SecretName,
+			Labels: map[string]string{
+				LABLE_KEY_SELF_SIGNED_SERVING: LABLE_KEY_GENERATED,
+				LABLE_EXPIRATION:              expiration,
+			},
+			Annotations: map[string]string{
+				ANNOTATION_SELF_SIGNED_HOSTS: ss.hostsAnnotation(),
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			SECRET_KEY_CA_CERT:  ca.cert,
+			SECRET_KEY_CA_KEY:   ca.key,
+			SECRET_KEY_TLS_CERT: serving.cert,
+			SECRET_KEY_TLS_KEY:  serving.key,
+		},
+	}, nil
+}
+
+func (ss *SelfSignedCertificate) load(secret *corev1.Secret) error {
+	if secret.ResourceVersion == ss.resourceVersion && ss.certificate != nil {
+		return nil
+	}
+	ca, err := CertificateFromPEM(secret.Name, secret.Data[SECRET_KEY_CA_CERT], secret.Data[SECRET_KEY_CA_KEY])
+	if err != nil {
+		return err
+	}
+	// Send the CA with the serving certificate so the chain is complete
+	chain := append(append([]byte{}, secret.Data[SECRET_KEY_TLS_CERT]...), ca.cert...)
+	certificate, err := tls.X509KeyPair(chain, secret.Data[SECRET_KEY_TLS_KEY])
+	if err != nil {
+		return err
+	}
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.ca = ca
+	ss.certificate = &certificate
+	ss.resourceVersion = secret.ResourceVersion
+	log.Printf("@I Serving self signed certificate from secret %v (version %v)\n", secret.Name, secret.ResourceVersion)
+	return nil
+}
+
+func (ss *SelfSignedCertificate) renewTask() {
+	ticker := time.NewTicker(SELF_SIGNED_CHECK_INTERVAL)
+	for range ticker.C {
+		err := ss.ensure()
+		if err != nil {
+			log.Printf("@E Error renewing self signed certificate: %+v\n", err)
+		}
+	}
+}
+
+// tls.Config GetCertificate callback
+func (ss *SelfSignedCertificate) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+	return ss.certificate, nil
+}
+
+// Unauthenticated handler for clients fetching the CA to pin
+func (ss *SelfSignedCertificate) serveCA(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(ss.ca.cert)
+}
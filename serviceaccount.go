@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/kubernetes-api/authentication-resources/token-request-v1/
+// https://kubernetes.io/docs/reference/access-authn-authz/rbac/#privilege-escalation-prevention-and-bootstrapping
+
+const (
+	LABLE_SERVICEACCOUNT = "auth.stiil.dk/serviceaccount"
+	// Username the ServiceAccount belongs to, names can not hold every username
+	ANNOTATION_USER               = "auth.stiil.dk/user"
+	SERVICEACCOUNT_TOKEN_LIFETIME = time.Hour
+	SERVICEACCOUNT_SYNC_INTERVAL  = 5 * time.Minute
+	// Tokens are renewed with less than a third of their lifetime left
+	SERVICEACCOUNT_TOKEN_RENEW_DIVISOR = 3
+	SERVICEACCOUNT_NAME_MAX            = 50
+)
+
+var invalidServiceAccountCharacters = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// Cached token of the ServiceAccount of one user
+type serviceAccountToken struct {
+	token      string
+	groups     string
+	expiration time.Time
+	lifetime   time.Duration
+	lastUsed   time.Time
+}
+
+func (token *serviceAccountToken) IsAboutToExpire() bool {
+	return time.Now().Add(token.lifetime / SERVICEACCOUNT_TOKEN_RENEW_DIVISOR).After(token.expiration)
+}
+
+func (token *serviceAccountToken) Stale() bool {
+	return token.lastUsed.Add(time.Minute * 30).Before(time.Now())
+}
+
+// Returns the Kubernetes groups of a user, ok false if the user lost access
+type groupRefresher func(username string) (groups []string, ok bool, err error)
+
+// ServiceAccounts per LDAP user and their tokens, for clusters without a client certificate signer
+type ServiceAccountStorage struct {
+	storage *sync.Map
+	client  *KubeClient
+	config  ServiceAccountConfig
+	// Only one binding sync at a time
+	syncMutex sync.Mutex
+}
+
+func NewServiceAccountStorage(client *KubeClient, config ServiceAccountConfig) *ServiceAccountStorage {
+	if config.TokenLifetime <= 0 {
+		config.TokenLifetime = SERVICEACCOUNT_TOKEN_LIFETIME
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = SERVICEACCOUNT_SYNC_INTERVAL
+	}
+	sas := &ServiceAccountStorage{storage: new(sync.Map), client: client, config: config}
+	go sas.cleanupTask()
+	return sas
+}
+
+// Valid ServiceAccount name for a username. Names that had to be changed get a hash so they stay unique.
+func serviceAccountName(username string) string {
+	name := strings.Trim(invalidServiceAccountCharacters.ReplaceAllString(strings.ToLower(username), "-"), "-.")
+	if name == username && len(name) <= SERVICEACCOUNT_NAME_MAX {
+		return name
+	}
+	if len(name) > SERVICEACCOUNT_NAME_MAX {
+		name = strings.Trim(name[:SERVICEACCOUNT_NAME_MAX], "-.")
+	}
+	if len(name) == 0 {
+		name = "user"
+	}
+	sum := sha256.Sum256([]byte(username))
+	return fmt.Sprintf("%s-%.4x", name, sum[:])
+}
+
+// Token for user, a new one is requested when expiring or when the groups changed
+func (sas *ServiceAccountStorage) GetToken(user *LDAPUser) (string, error) {
+	name := serviceAccountName(user.User)
+	groups := groupsToString(user.Groups)
+	if cached, ok := sas.storage.Load(name); ok {
+		token := cached.(*serviceAccountToken)
+		if !token.IsAboutToExpire() && token.groups == groups {
+			token.lastUsed = time.Now()
+			return token.token, nil
+		}
+	}
+	changed, err := sas.ensureServiceAccount(name, user.User, groups)
+	if err != nil {
+		return "", err
+	}
+	if changed {
+		// Bindings must be in place before the token is used
+		err = sas.syncBindings()
+		if err != nil {
+			return "", err
+		}
+	}
+	tokenRequest, err := sas.client.CreateToken(name, sas.config.TokenLifetime)
+	if err != nil {
+		return "", err
+	}
+	token := &serviceAccountToken{
+		token:      tokenRequest.Status.Token,
+		groups:     groups,
+		expiration: tokenRequest.Status.ExpirationTimestamp.Time,
+		lifetime:   sas.config.TokenLifetime,
+		lastUsed:   time.Now(),
+	}
+	sas.storage.Store(name, token)
+	return token.token, nil
+}
+
+// Create the ServiceAccount or update its groups. Returns true if anything changed.
+func (sas *ServiceAccountStorage) ensureServiceAccount(name string, username string, groups string) (bool, error) {
+	serviceAccount, err := sas.client.GetServiceAccount(name)
+	if apierros.IsNotFound(err) {
+		log.Printf("No ServiceAccount found for user %v creating %v\n", username, name)
+		_, err = sas.client.CreateServiceAccount(&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Labels:      map[string]string{LABLE_SERVICEACCOUNT: LABLE_KEY_GENERATED},
+				Annotations: map[string]string{ANNOTATION_USER: username, ANNOTATION_GROUPS: groups},
+			},
+		})
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if serviceAccount.Annotations[ANNOTATION_USER] != username {
+		return false, fmt.Errorf("ServiceAccount %v belongs to %v, not %v", name, serviceAccount.Annotations[ANNOTATION_USER], username)
+	}
+	if serviceAccount.Annotations[ANNOTATION_GROUPS] == groups {
+		return false, nil
+	}
+	log.Printf("ServiceAccount %v groups changed\n", name)
+	serviceAccount.Annotations[ANNOTATION_GROUPS] = groups
+	_, err = sas.client.UpdateServiceAccount(serviceAccount)
+	return err == nil, err
+}
+
+func bindingName(binding ServiceAccountBindingConfig) string {
+	return serviceAccountName(fmt.Sprintf("kube-auth-proxy-%s-%s", binding.Group, binding.ClusterRole))
+}
+
+// Bindings without the ServiceAccount label were not created by the proxy and are never overwritten
+func checkManagedBinding(existing metav1.ObjectMeta) error {
+	if existing.Labels[LABLE_SERVICEACCOUNT] != LABLE_KEY_GENERATED {
+		return fmt.Errorf("binding %v exists without label %v=%v, refusing to update it", existing.Name, LABLE_SERVICEACCOUNT, LABLE_KEY_GENERATED)
+	}
+	return nil
+}
+
+// ServiceAccounts with group in their groups annotation
+func bindingSubjects(serviceAccounts []corev1.ServiceAccount, namespace string, group string) []rbacv1.Subject {
+	subjects := []rbacv1.Subject{}
+	for _, serviceAccount := range serviceAccounts {
+		if slices.Contains(strings.Split(serviceAccount.Annotations[ANNOTATION_GROUPS], ","), group) {
+			subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount.Name, Namespace: namespace})
+		}
+	}
+	return subjects
+}
+
+// Make the configured bindings hold exactly the ServiceAccounts of the members of their group.
+// A failing binding does not stop the others or the removal of stale bindings, all errors are returned together.
+func (sas *ServiceAccountStorage) syncBindings() error {
+	sas.syncMutex.Lock()
+	defer sas.syncMutex.Unlock()
+	selector := LABLE_SERVICEACCOUNT + "=" + LABLE_KEY_GENERATED
+	serviceAccounts, err := sas.client.ListServiceAccounts(selector)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	labels := map[string]string{LABLE_SERVICEACCOUNT: LABLE_KEY_GENERATED}
+	wanted := make(map[string]bool)
+	for _, binding := range sas.config.Bindings {
+		name := bindingName(binding)
+		roleRef := rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: binding.ClusterRole}
+		subjects := bindingSubjects(serviceAccounts.Items, sas.client.namespace, binding.Group)
+		if len(binding.Namespace) > 0 {
+			wanted[binding.Namespace+"/"+name] = true
+			err = sas.client.ApplyRoleBinding(&rbacv1.RoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: binding.Namespace, Labels: labels},
+				RoleRef:    roleRef,
+				Subjects:   subjects,
+			})
+		} else {
+			wanted[name] = true
+			err = sas.client.ApplyClusterRoleBinding(&rbacv1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+				RoleRef:    roleRef,
+				Subjects:   subjects,
+			})
+		}
+		if err != nil {
+			err = fmt.Errorf("binding %v for group %v: %w", name, binding.Group, err)
+			log.Printf("@E Applying %+v\n", err)
+			errs = append(errs, err)
+		}
+	}
+	// Remove bindings no longer configured
+	clusterRoleBindings, err := sas.client.ListClusterRoleBindings(selector)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, binding := range clusterRoleBindings.Items {
+			if !wanted[binding.Name] {
+				log.Printf("Deleting ClusterRoleBinding %v no longer configured\n", binding.Name)
+				err = sas.client.DeleteClusterRoleBinding(binding.Name)
+				if err != nil {
+					log.Printf("@E Deleting ClusterRoleBinding %v: %+v\n", binding.Name, err)
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	roleBindings, err := sas.client.ListRoleBindings(selector)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, binding := range roleBindings.Items {
+			if !wanted[binding.Namespace+"/"+binding.Name] {
+				log.Printf("Deleting RoleBinding %v/%v no longer configured\n", binding.Namespace, binding.Name)
+				err = sas.client.DeleteRoleBinding(binding.Namespace, binding.Name)
+				if err != nil {
+					log.Printf("@E Deleting RoleBinding %v/%v: %+v\n", binding.Namespace, binding.Name, err)
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check every ServiceAccount against LDAP, remove users that lost access and resync the bindings
+func (sas *ServiceAccountStorage) syncTask(refresh groupRefresher) {
+	ticker := time.NewTicker(sas.config.SyncInterval)
+	for ; true; <-ticker.C {
+		serviceAccounts, err := sas.client.ListServiceAccounts(LABLE_SERVICEACCOUNT + "=" + LABLE_KEY_GENERATED)
+		if err != nil {
+			log.Printf("@E Listing ServiceAccounts: %+v\n", err)
+			continue
+		}
+		var count, deleted uint32
+		for _, serviceAccount := range serviceAccounts.Items {
+			count += 1
+			username := serviceAccount.Annotations[ANNOTATION_USER]
+			groups, ok, err := refresh(username)
+			if err != nil {
+				log.Printf("@E Refreshing groups of %v: %+v\n", username, err)
+				continue
+			}
+			if !ok {
+				deleted += 1
+				log.Printf("@I User %v lost access, deleting ServiceAccount %v\n", username, serviceAccount.Name)
+				sas.storage.Delete(serviceAccount.Name)
+				sas.client.DeleteServiceAccount(serviceAccount.Name)
+				continue
+			}
+			_, err = sas.ensureServiceAccount(serviceAccount.Name, username, groupsToString(groups))
+			if err != nil {
+				log.Printf("@E Updating ServiceAccount %v: %+v\n", serviceAccount.Name, err)
+			}
+		}
+		err = sas.syncBindings()
+		if err != nil {
+			log.Printf("@E Syncing bindings: %+v\n", err)
+		}
+		log.Printf("Sync of %v ServiceAccounts, Removed %v without access.", count, deleted)
+	}
+}
+
+func (sas *ServiceAccountStorage) cleanupTask() {
+	ticker := time.NewTicker(5 * time.Minute)
+	for range ticker.C {
+		var count, deleted uint32
+		sas.storage.Range(func(key, value any) bool {
+			count += 1
+			if value.(*serviceAccountToken).Stale() {
+				deleted += 1
+				sas.storage.Delete(key)
+			}
+			return true
+		})
+		log.Printf("Cleanup of %v ServiceAccount tokens, Removed %v stale tokens.", count, deleted)
+	}
+}
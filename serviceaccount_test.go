@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func Test_ServiceAccount(t *testing.T) {
+	t.Run("Names", func(t *testing.T) {
+		names := make(map[string]string)
+		for _, username := range []string{"alice", "Alice", "alice@example.com", "EXAMPLE\\alice", "-", strings.Repeat("a", 80)} {
+			name := serviceAccountName(username)
+			if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+				t.Errorf("Error: %v: %v %v", username, name, errs)
+			}
+			if other, ok := names[name]; ok {
+				t.Errorf("Error: %v and %v share %v", username, other, name)
+			}
+			names[name] = username
+		}
+		if name := serviceAccountName("alice"); name != "alice" {
+			t.Errorf("Error: %v != alice", name)
+		}
+	})
+	t.Run("Binding Subjects", func(t *testing.T) {
+		serviceAccounts := []corev1.ServiceAccount{
+			{ObjectMeta: metav1.ObjectMeta{Name: "alice", Annotations: map[string]string{ANNOTATION_GROUPS: "developers,sre"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "bob", Annotations: map[string]string{ANNOTATION_GROUPS: "developers"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "carol", Annotations: map[string]string{ANNOTATION_GROUPS: "sre-oncall"}}},
+		}
+		subjects := bindingSubjects(serviceAccounts, "kube-auth-proxy", "sre")
+		if len(subjects) != 1 || subjects[0].Name != "alice" || subjects[0].Namespace != "kube-auth-proxy" {
+			t.Errorf("Error: %+v", subjects)
+		}
+		if subjects := bindingSubjects(serviceAccounts, "kube-auth-proxy", "admins"); subjects == nil || len(subjects) != 0 {
+			t.Errorf("Error: %+v", subjects)
+		}
+	})
+	t.Run("Managed Bindings", func(t *testing.T) {
+		managed := metav1.ObjectMeta{Name: "kube-auth-proxy-sre-edit", Labels: map[string]string{LABLE_SERVICEACCOUNT: LABLE_KEY_GENERATED}}
+		if err := checkManagedBinding(managed); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if err := checkManagedBinding(metav1.ObjectMeta{Name: "cluster-admin"}); err == nil {
+			t.Errorf("Error: unlabelled binding would be overwritten")
+		}
+	})
+	t.Run("Token Renewal", func(t *testing.T) {
+		token := &serviceAccountToken{lifetime: time.Hour, expiration: time.Now().Add(time.Hour)}
+		if token.IsAboutToExpire() {
+			t.Errorf("Error: new token about to expire")
+		}
+		token.expiration = time.Now().Add(15 * time.Minute)
+		if !token.IsAboutToExpire() {
+			t.Errorf("Error: token with a quarter left not renewed")
+		}
+	})
+}
+
+func Test_ServiceAccountSyncBindings(t *testing.T) {
+	unmanaged := ServiceAccountBindingConfig{Group: "admins", ClusterRole: "admin"}
+	configured := ServiceAccountBindingConfig{Group: "sre", ClusterRole: "edit"}
+	const rbac = "/apis/rbac.authorization.k8s.io/v1"
+	var mutex sync.Mutex
+	var requests []string
+	// API server with an unmanaged binding in the way, a missing binding and a stale managed binding
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/namespaces/kube-auth-proxy/serviceaccounts":
+			w.Write([]byte(`{"kind":"ServiceAccountList","apiVersion":"v1","items":[]}`))
+		case "GET " + rbac + "/clusterrolebindings/" + bindingName(unmanaged):
+			w.Write([]byte(`{"kind":"ClusterRoleBinding","apiVersion":"rbac.authorization.k8s.io/v1","metadata":{"name":"` + bindingName(unmanaged) + `"},"roleRef":{"apiGroup":"rbac.authorization.k8s.io","kind":"ClusterRole","name":"admin"}}`))
+		case "GET " + rbac + "/clusterrolebindings/" + bindingName(configured):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+		case "POST " + rbac + "/clusterrolebindings":
+			w.WriteHeader(http.StatusCreated)
+			io.Copy(w, r.Body)
+		case "GET " + rbac + "/clusterrolebindings":
+			w.Write([]byte(`{"kind":"ClusterRoleBindingList","apiVersion":"rbac.authorization.k8s.io/v1","items":[{"metadata":{"name":"kube-auth-proxy-old-view","labels":{"` + LABLE_SERVICEACCOUNT + `":"` + LABLE_KEY_GENERATED + `"}},"roleRef":{"apiGroup":"rbac.authorization.k8s.io","kind":"ClusterRole","name":"view"}}]}`))
+		case "DELETE " + rbac + "/clusterrolebindings/kube-auth-proxy-old-view":
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Success"}`))
+		case "GET " + rbac + "/rolebindings":
+			w.Write([]byte(`{"kind":"RoleBindingList","apiVersion":"rbac.authorization.k8s.io/v1","items":[]}`))
+		default:
+			t.Errorf("Error: unexpected request %v %v", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &KubeClient{clientset: clientset, Context: context.Background(), namespace: "kube-auth-proxy"}
+	sas := &ServiceAccountStorage{client: client, config: ServiceAccountConfig{Bindings: []ServiceAccountBindingConfig{unmanaged, configured}}}
+	err = sas.syncBindings()
+	if err == nil || !strings.Contains(err.Error(), bindingName(unmanaged)) {
+		t.Errorf("Error: unmanaged binding not reported: %v", err)
+	}
+	for _, expected := range []string{
+		"POST " + rbac + "/clusterrolebindings",
+		"DELETE " + rbac + "/clusterrolebindings/kube-auth-proxy-old-view",
+	} {
+		if !slices.Contains(requests, expected) {
+			t.Errorf("Error: %v skipped after a failing binding: %v", expected, requests)
+		}
+	}
+}
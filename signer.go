@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/access-authn-authz/certificate-signing-requests/
+// https://kubernetes.io/docs/tasks/administer-cluster/certificates/
+
+const (
+	SIGNER_CSRAPI  = "csrapi"
+	SIGNER_LOCALCA = "localca"
+	// Signer of client certificates trusted by the API servers
+	SIGNER_NAME_APISERVER_CLIENT = "kubernetes.io/kube-apiserver-client"
+	// The proxy approves its own CSRs, unless they carry one of ExternalApprovalGroups
+	APPROVAL_AUTO = "auto"
+	// A policy controller or a human approves or denies the CSRs
+	APPROVAL_EXTERNAL = "external"
+	// Deadline for external approval, self-approved CSRs are signed within CERTIFICATE_FETCH_TIMEOUT_SECONDS
+	APPROVAL_EXTERNAL_TIMEOUT = 2 * time.Minute
+	// Allow for clock skew between the proxy and the API servers
+	SIGNER_BACKDATE = 5 * time.Minute
+)
+
+// Signs a PEM encoded certificate signing request and returns the PEM encoded certificate.
+// A lifetime of 0 uses the default expiration of the signer.
+type CertificateSigner interface {
+	Sign(name string, csr []byte, lifetime time.Duration) ([]byte, error)
+}
+
+// A CSR that was denied or not signed in time
+type CSRError struct {
+	Name   string
+	Denied bool
+	// Still waiting for external approval, the CSR is kept for the next request
+	Pending bool
+	Reason  string
+}
+
+func (err *CSRError) Error() string {
+	if err.Denied {
+		return fmt.Sprintf("certificate signing request %v was denied: %v", err.Name, err.Reason)
+	}
+	if err.Pending {
+		return fmt.Sprintf("certificate signing request %v is waiting for approval, retry when it is approved", err.Name)
+	}
+	return fmt.Sprintf("certificate signing request %v was %v", err.Name, err.Reason)
+}
+
+func NewCertificateSigner(config SignerConfig, client *KubeClient) (CertificateSigner, error) {
+	switch config.Type {
+	case "", SIGNER_CSRAPI:
+		return newCSRAPISigner(config, client)
+	case SIGNER_LOCALCA:
+		if config.Approval == APPROVAL_EXTERNAL || len(config.ExternalApprovalGroups) > 0 {
+			return nil, errors.New("local CA signer signs without approval, external approval needs the csrapi signer")
+		}
+		return newLocalCASigner(config)
+	default:
+		return nil, fmt.Errorf("unknown signer %v, use %v or %v", config.Type, SIGNER_CSRAPI, SIGNER_LOCALCA)
+	}
+}
+
+// Signs through the CertificateSigningRequest API of the cluster
+type csrAPISigner struct {
+	client                 *KubeClient
+	signerName             string
+	externalApproval       bool
+	externalApprovalGroups []string
+	approvalTimeout        time.Duration
+}
+
+func newCSRAPISigner(config SignerConfig, client *KubeClient) (*csrAPISigner, error) {
+	signer := &csrAPISigner{
+		client:                 client,
+		signerName:             config.SignerName,
+		externalApprovalGroups: config.ExternalApprovalGroups,
+		approvalTimeout:        config.ApprovalTimeout,
+	}
+	if len(signer.signerName) == 0 {
+		signer.signerName = SIGNER_NAME_APISERVER_CLIENT
+	}
+	switch config.Approval {
+	case "", APPROVAL_AUTO:
+	case APPROVAL_EXTERNAL:
+		signer.externalApproval = true
+	default:
+		return nil, fmt.Errorf("unknown approval %v, use %v or %v", config.Approval, APPROVAL_AUTO, APPROVAL_EXTERNAL)
+	}
+	if signer.approvalTimeout <= 0 {
+		signer.approvalTimeout = APPROVAL_EXTERNAL_TIMEOUT
+	}
+	return signer, nil
+}
+
+// Does the CSR have to wait for an external approver
+func (signer *csrAPISigner) needsExternalApproval(csr []byte) (bool, error) {
+	if signer.externalApproval {
+		return true, nil
+	}
+	if len(signer.externalApprovalGroups) == 0 {
+		return false, nil
+	}
+	request, err := parseCertificateRequest(csr)
+	if err != nil {
+		return false, err
+	}
+	for _, group := range request.Subject.Organization {
+		if slices.Contains(signer.externalApprovalGroups, group) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (signer *csrAPISigner) Sign(name string, csr []byte, lifetime time.Duration) ([]byte, error) {
+	external, err := signer.needsExternalApproval(csr)
+	if err != nil {
+		return nil, err
+	}
+	timeout := CERTIFICATE_FETCH_TIMEOUT_SECONDS * time.Second
+	if external {
+		timeout = signer.approvalTimeout
+	}
+	existing, err := signer.createCSR(name, csr, lifetime, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if external {
+		log.Printf("@I Waiting up to %v for external approval of CSR %v\n", signer.approvalTimeout, name)
+	} else if existing == nil || !isApproved(existing) {
+		err = signer.client.ApproveCSR(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := signer.client.GetSignedCertificate(name, timeout)
+	var csrError *CSRError
+	if errors.As(err, &csrError) {
+		if csrError.Pending && external {
+			// Kept with its key, so an approval after the timeout is picked up by the next request
+			return nil, csrError
+		}
+		// Self-approved CSRs that are not signed in time are not waiting for anyone
+		csrError.Pending = false
+		if csrError.Denied {
+			log.Printf("@S %v\n", csrError)
+		}
+	}
+	// Denied and unsigned CSRs are removed too, so the next request can create a new one
+	deleteErr := signer.client.DeleteCSR(name)
+	if deleteErr != nil {
+		log.Printf("Warning: Issue deleting CSR: %+v", deleteErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Create the CSR. Returns the existing CSR if an earlier request created it for the same key.
+// CSRs for another key older than timeout were abandoned, for example by a restart, and are replaced.
+func (signer *csrAPISigner) createCSR(name string, csr []byte, lifetime time.Duration, timeout time.Duration) (*certificatesv1.CertificateSigningRequest, error) {
+	_, err := signer.client.CreateCSR(name, signer.signerName, csr, lifetime)
+	if !apierros.IsAlreadyExists(err) {
+		return nil, err
+	}
+	existing, err := signer.client.GetCSR(name)
+	if err != nil {
+		return nil, err
+	}
+	if samePublicKey(existing.Spec.Request, csr) {
+		log.Printf("@I Resuming CSR %v\n", name)
+		return existing, nil
+	}
+	if time.Since(existing.CreationTimestamp.Time) < timeout {
+		// Another request of the user is still waiting for its certificate
+		return nil, &CSRError{Name: name, Reason: "already pending"}
+	}
+	log.Printf("@I Replacing abandoned CSR %v created %v\n", name, existing.CreationTimestamp)
+	err = signer.client.DeleteCSR(name)
+	if err != nil && !apierros.IsNotFound(err) {
+		return nil, err
+	}
+	_, err = signer.client.CreateCSR(name, signer.signerName, csr, lifetime)
+	return nil, err
+}
+
+func isApproved(csr *certificatesv1.CertificateSigningRequest) bool {
+	for _, condition := range csr.Status.Conditions {
+		if condition.Type == certificatesv1.CertificateApproved {
+			return true
+		}
+	}
+	return false
+}
+
+// Do both PEM CSRs belong to the same key
+func samePublicKey(first []byte, second []byte) bool {
+	firstRequest, err := parseCertificateRequest(first)
+	if err != nil {
+		return false
+	}
+	secondRequest, err := parseCertificateRequest(second)
+	if err != nil {
+		return false
+	}
+	publicKey, ok := firstRequest.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && publicKey.Equal(secondRequest.PublicKey)
+}
+
+func parseCertificateRequest(csr []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csr)
+	if block == nil || block.Type != TYPE_CERTIFICATE_REQUEST {
+		return nil, errors.New("no certificate request found")
+	}
+	return x509.ParseCertificateRequest(block.Bytes)
+}
+
+// Signs with a CA certificate and key trusted by the API servers (--client-ca-file)
+type localCASigner struct {
+	certificate *x509.Certificate
+	key         crypto.Signer
+}
+
+func newLocalCASigner(config SignerConfig) (*localCASigner, error) {
+	if len(config.CACertificate) == 0 || len(config.CAKey) == 0 {
+		return nil, errors.New("local CA signer needs CACertificate and CAKey")
+	}
+	certPEM, err := loadPEM(config.CACertificate)
+	if err != nil {
+		return nil, fmt.Errorf("signer CA certificate: %w", err)
+	}
+	keyPEM, err := loadPEM(config.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("signer CA key: %w", err)
+	}
+	// X509KeyPair checks that the key belongs to the certificate
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("signer CA: %w", err)
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !certificate.IsCA {
+		return nil, fmt.Errorf("signer certificate %v is not a CA", certificate.Subject.CommonName)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("signer CA key can not sign")
+	}
+	return &localCASigner{certificate: certificate, key: key}, nil
+}
+
+func (signer *localCASigner) Sign(name string, csr []byte, lifetime time.Duration) ([]byte, error) {
+	request, err := parseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	err = request.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+	if lifetime <= 0 {
+		lifetime = CERTIFICATE_EXPIRATION_SECONDS * time.Second
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(lifetime)
+	// Like the kube-controller-manager signer, never outlive the CA
+	if notAfter.After(signer.certificate.NotAfter) {
+		notAfter = signer.certificate.NotAfter
+	}
+	// Same usages as the kubernetes.io/kube-apiserver-client signer
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               request.Subject,
+		NotBefore:             now.Add(-SIGNER_BACKDATE),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	signed, err := x509.CreateCertificate(rand.Reader, template, signer.certificate, request.PublicKey, signer.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: TYPE_CERTIFICATE, Bytes: signed}), nil
+}
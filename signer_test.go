@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+)
+
+func Test_LocalCASigner(t *testing.T) {
+	ca := testCA(t, "test-client-ca")
+	signer, err := NewCertificateSigner(SignerConfig{Type: SIGNER_LOCALCA, CACertificate: ca.GetPEMCert(), CAKey: ca.GetPEMKey()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &Certificate{}
+	if err := user.createEllipticKey(); err != nil {
+		t.Fatal(err)
+	}
+	csr, err := user.createCSR("ldap:alice", "developers", "sre")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Sign", func(t *testing.T) {
+		user.cert, err = signer.Sign("alice", csr, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := user.getCertificate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// DER sorts the organizations of a SET
+		organizations := slices.Sorted(slices.Values(cert.Subject.Organization))
+		if cert.Subject.CommonName != "ldap:alice" || !slices.Equal(organizations, []string{"developers", "sre"}) {
+			t.Errorf("Error: subject %v", cert.Subject)
+		}
+		if cert.NotAfter.After(time.Now().Add(time.Hour)) || cert.NotAfter.Before(time.Now().Add(time.Minute*59)) {
+			t.Errorf("Error: lifetime not applied %v", cert.NotAfter)
+		}
+		caCert, _ := ca.getCertificate()
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+	})
+	t.Run("Capped By CA", func(t *testing.T) {
+		signed, err := signer.Sign("alice", csr, time.Hour*24*365)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &Certificate{cert: signed}
+		notAfter, err := cert.getCertificateNotAfterTime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		caCert, _ := ca.getCertificate()
+		if notAfter.After(caCert.NotAfter) {
+			t.Errorf("Error: %v outlives CA %v", notAfter, caCert.NotAfter)
+		}
+	})
+	t.Run("Invalid Config", func(t *testing.T) {
+		if _, err := NewCertificateSigner(SignerConfig{Type: SIGNER_LOCALCA}, nil); err == nil {
+			t.Errorf("Error: missing CA accepted")
+		}
+		if _, err := NewCertificateSigner(SignerConfig{Type: "vault"}, nil); err == nil {
+			t.Errorf("Error: unknown signer accepted")
+		}
+		if _, err := NewCertificateSigner(SignerConfig{Type: SIGNER_LOCALCA, CACertificate: user.GetPEMCert(), CAKey: user.GetPEMKey()}, nil); err == nil {
+			t.Errorf("Error: non CA certificate accepted")
+		}
+	})
+}
+
+func Test_CSRApproval(t *testing.T) {
+	user := &Certificate{}
+	if err := user.createEllipticKey(); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := user.createCSR("alice", "developers", "cluster-admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	developer, err := user.createCSR("bob", "developers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Defaults", func(t *testing.T) {
+		signer, err := newCSRAPISigner(SignerConfig{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer.signerName != SIGNER_NAME_APISERVER_CLIENT {
+			t.Errorf("Error: %v != %v", signer.signerName, SIGNER_NAME_APISERVER_CLIENT)
+		}
+		if external, _ := signer.needsExternalApproval(admin); external {
+			t.Errorf("Error: auto approval waits for external approval")
+		}
+	})
+	t.Run("External Approval Groups", func(t *testing.T) {
+		signer, err := newCSRAPISigner(SignerConfig{ExternalApprovalGroups: []string{"cluster-admins"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if external, _ := signer.needsExternalApproval(admin); !external {
+			t.Errorf("Error: privileged group self-approved")
+		}
+		if external, _ := signer.needsExternalApproval(developer); external {
+			t.Errorf("Error: unprivileged groups wait for external approval")
+		}
+	})
+	t.Run("External Approval", func(t *testing.T) {
+		signer, err := newCSRAPISigner(SignerConfig{Approval: APPROVAL_EXTERNAL, SignerName: "example.com/kube-auth-proxy"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if external, _ := signer.needsExternalApproval(developer); !external || signer.approvalTimeout != APPROVAL_EXTERNAL_TIMEOUT {
+			t.Errorf("Error: %v %v", external, signer.approvalTimeout)
+		}
+		if _, err := newCSRAPISigner(SignerConfig{Approval: "never"}, nil); err == nil {
+			t.Errorf("Error: unknown approval accepted")
+		}
+		if _, err := NewCertificateSigner(SignerConfig{Type: SIGNER_LOCALCA, Approval: APPROVAL_EXTERNAL}, nil); err == nil {
+			t.Errorf("Error: external approval accepted for local CA")
+		}
+	})
+	t.Run("Resume Same Key", func(t *testing.T) {
+		again, err := user.createCSR("alice", "developers", "cluster-admins")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePublicKey(admin, again) {
+			t.Errorf("Error: CSRs of the same key not matched")
+		}
+		other := &Certificate{}
+		if err := other.createEllipticKey(); err != nil {
+			t.Fatal(err)
+		}
+		abandoned, err := other.createCSR("alice", "developers", "cluster-admins")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if samePublicKey(admin, abandoned) {
+			t.Errorf("Error: CSR of another key matched")
+		}
+		csr := &certificatesv1.CertificateSigningRequest{}
+		if isApproved(csr) {
+			t.Errorf("Error: new CSR approved")
+		}
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{Type: certificatesv1.CertificateApproved})
+		if !isApproved(csr) {
+			t.Errorf("Error: approved CSR not seen as approved")
+		}
+	})
+	t.Run("Status", func(t *testing.T) {
+		denied := csrStatus(&CSRError{Name: "alice", Denied: true, Reason: "NotOnCall"})
+		if denied.ErrStatus.Code != http.StatusForbidden || !strings.Contains(denied.ErrStatus.Message, "alice") {
+			t.Errorf("Error: %+v", denied.ErrStatus)
+		}
+		pending := csrStatus(&CSRError{Name: "bob", Reason: "not signed within 2m0s"})
+		if pending.ErrStatus.Code != http.StatusServiceUnavailable || !strings.Contains(pending.ErrStatus.Message, "bob") {
+			t.Errorf("Error: %+v", pending.ErrStatus)
+		}
+		waiting := csrStatus(&CSRError{Name: "carol", Pending: true})
+		if waiting.ErrStatus.Code != http.StatusServiceUnavailable || !strings.Contains(waiting.ErrStatus.Message, "carol") {
+			t.Errorf("Error: %+v", waiting.ErrStatus)
+		}
+	})
+}
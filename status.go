@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// Good documentation:
+// https://kubernetes.io/docs/reference/using-api/api-concepts/#responses
+
+// Write an error as a Kubernetes Status object so kubectl and client-go understand it
+func writeStatus(w http.ResponseWriter, statusError *apierros.StatusError) {
+	status := statusError.ErrStatus
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+	body, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	w.Write(body)
+}
+
+// Denied CSRs are forbidden, CSRs still waiting for approval or signing are unavailable
+func csrStatus(csrError *CSRError) *apierros.StatusError {
+	if csrError.Denied {
+		return apierros.NewForbidden(certificatesv1.Resource("certificatesigningrequests"), csrError.Name, csrError)
+	}
+	return apierros.NewServiceUnavailable(csrError.Error())
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Good documentation:
+// https://cheatsheetseries.owasp.org/cheatsheets/Authentication_Cheat_Sheet.html#protect-against-automated-attacks
+
+// Failed logins for a username or a client IP
+type throttleEntry struct {
+	Failures     int       `json:"failures"`
+	FirstFailure time.Time `json:"firstFailure"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+}
+
+// Storage of throttle entries. update is called with the current entry (nil if none)
+// and returns the entry to store, or nil to remove it.
+type ThrottleStore interface {
+	Load(key string) (*throttleEntry, error)
+	Update(key string, update func(entry *throttleEntry) *throttleEntry) error
+}
+
+// Throttles failed logins by username, and optionally client IP, before LDAP is contacted
+type LoginThrottle struct {
+	config ThrottleConfig
+	store  ThrottleStore
+}
+
+const (
+	THROTTLE_STORE_MEMORY    = "memory"
+	THROTTLE_STORE_SECRET    = "secret"
+	THROTTLE_STORE_CONFIGMAP = "configmap"
+	THROTTLE_STORE_NAME      = "kube-auth-proxy-throttle"
+	THROTTLE_KEY_USER        = "user:"
+	THROTTLE_KEY_IP          = "ip:"
+	// Shared state is read at most this often per replica, failures and resets are written straight away
+	THROTTLE_STORE_CACHE_TTL = 5 * time.Second
+)
+
+func NewLoginThrottle(config ThrottleConfig, client *KubeClient) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{config: config}
+	switch config.Store {
+	case THROTTLE_STORE_MEMORY, "":
+		throttle.store = NewMemoryThrottleStore(config.Window + config.LockoutDuration)
+	case THROTTLE_STORE_SECRET, THROTTLE_STORE_CONFIGMAP:
+		throttle.store = &KubeThrottleStore{client: client, kind: config.Store, name: config.StoreName, retention: config.Window + config.LockoutDuration}
+	default:
+		return nil, fmt.Errorf("unknown throttle store %v", config.Store)
+	}
+	return throttle, nil
+}
+
+// Client address of the request, optionally from X-Forwarded-For when behind an ingress
+func (throttle *LoginThrottle) clientIP(r *http.Request) string {
+	if throttle.config.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); len(forwarded) > 0 {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Behind an ingress every client has the ingress address, so failures per IP only count when enabled
+func (throttle *LoginThrottle) keys(username string, ip string) []string {
+	keys := []string{THROTTLE_KEY_USER + strings.ToLower(username)}
+	if throttle.config.PerClientIP {
+		keys = append(keys, THROTTLE_KEY_IP+ip)
+	}
+	return keys
+}
+
+// Time until a new login attempt is allowed, 0 if allowed now
+func (throttle *LoginThrottle) Check(username string, ip string) time.Duration {
+	var retryAfter time.Duration
+	for _, key := range throttle.keys(username, ip) {
+		entry, err := throttle.store.Load(key)
+		if err != nil {
+			// Fail open, we should not lock everyone out if the store is unavailable
+			log.Printf("@E Error reading throttle state for %v: %+v\n", key, err)
+			continue
+		}
+		if entry != nil {
+			if wait := time.Until(entry.BlockedUntil); wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return retryAfter
+}
+
+// Login stopped before the password was checked
+type ThrottledError struct {
+	Username   string
+	RetryAfter time.Duration
+}
+
+func (err *ThrottledError) Error() string {
+	return fmt.Sprintf("login for %v throttled for %v", err.Username, err.RetryAfter)
+}
+
+// Checks the canonical username found in LDAP, the username as typed may be another form of it
+func (throttle *LoginThrottle) guard(ip string) loginGuard {
+	return func(username string) error {
+		if retryAfter := throttle.Check(username, ip); retryAfter > 0 {
+			return &ThrottledError{Username: username, RetryAfter: retryAfter}
+		}
+		return nil
+	}
+}
+
+// Record a failed login, backing off exponentially and locking out after MaxFailures within Window
+func (throttle *LoginThrottle) Failure(username string, ip string) {
+	for _, key := range throttle.keys(username, ip) {
+		err := throttle.store.Update(key, func(entry *throttleEntry) *throttleEntry {
+			now := time.Now()
+			if entry == nil || now.Sub(entry.FirstFailure) > throttle.config.Window {
+				entry = &throttleEntry{FirstFailure: now}
+			}
+			entry.Failures += 1
+			if throttle.config.MaxFailures > 0 && entry.Failures >= throttle.config.MaxFailures {
+				entry.BlockedUntil = now.Add(throttle.config.LockoutDuration)
+				log.Printf("@S Locking out %v for %v after %v failed logins\n", key, throttle.config.LockoutDuration, entry.Failures)
+			} else {
+				entry.BlockedUntil = now.Add(throttle.backoff(entry.Failures))
+			}
+			return entry
+		})
+		if err != nil {
+			log.Printf("@E Error storing throttle state for %v: %+v\n", key, err)
+		}
+	}
+}
+
+// Forget failed logins for a user after a successful login. The client IP is kept.
+func (throttle *LoginThrottle) Success(username string) {
+	key := THROTTLE_KEY_USER + strings.ToLower(username)
+	entry, err := throttle.store.Load(key)
+	if err != nil || entry == nil {
+		return
+	}
+	err = throttle.store.Update(key, func(entry *throttleEntry) *throttleEntry { return nil })
+	if err != nil {
+		log.Printf("@E Error clearing throttle state for %v: %+v\n", key, err)
+	}
+}
+
+func (throttle *LoginThrottle) backoff(failures int) time.Duration {
+	delay := throttle.config.BaseDelay
+	for i := 1; i < failures && delay < throttle.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > throttle.config.MaxDelay {
+		delay = throttle.config.MaxDelay
+	}
+	return delay
+}
+
+func (entry *throttleEntry) expired(retention time.Duration) bool {
+	return time.Now().After(entry.BlockedUntil) && time.Since(entry.FirstFailure) > retention
+}
+
+// --- In memory store for single replica deployments ---
+
+type MemoryThrottleStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*throttleEntry
+	retention time.Duration
+}
+
+func NewMemoryThrottleStore(retention time.Duration) *MemoryThrottleStore {
+	store := &MemoryThrottleStore{entries: make(map[string]*throttleEntry), retention: retention}
+	go store.cleanupTask()
+	return store
+}
+
+func (store *MemoryThrottleStore) Load(key string) (*throttleEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	loaded := *entry
+	return &loaded, nil
+}
+
+func (store *MemoryThrottleStore) Update(key string, update func(entry *throttleEntry) *throttleEntry) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry := update(store.entries[key])
+	if entry == nil {
+		delete(store.entries, key)
+	} else {
+		store.entries[key] = entry
+	}
+	return nil
+}
+
+func (store *MemoryThrottleStore) cleanupTask() {
+	ticker := time.NewTicker(5 * time.Minute)
+	for range ticker.C {
+		store.mutex.Lock()
+		for key, entry := range store.entries {
+			if entry.expired(store.retention) {
+				delete(store.entries, key)
+			}
+		}
+		store.mutex.Unlock()
+	}
+}
+
+// --- Secret or ConfigMap store shared between replicas ---
+
+type KubeThrottleStore struct {
+	client    *KubeClient
+	kind      string
+	name      string
+	retention time.Duration
+	// Entries last read or written, so logins do not read the object every time
+	mutex    sync.Mutex
+	cache    map[string]*throttleEntry
+	cachedAt time.Time
+}
+
+// Keys in Secrets and ConfigMaps are limited to [-._a-zA-Z0-9]
+func (store *KubeThrottleStore) dataKey(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// Read the stored entries, returns the object for updating or nil if it does not exist
+func (store *KubeThrottleStore) read() (map[string]*throttleEntry, metav1.Object, error) {
+	entries := make(map[string]*throttleEntry)
+	var object metav1.Object
+	var data map[string][]byte
+	if store.kind == THROTTLE_STORE_SECRET {
+		secret, err := store.client.GetSecret(store.name)
+		if apierros.IsNotFound(err) {
+			return entries, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		object, data = secret, secret.Data
+	} else {
+		configMap, err := store.client.GetConfigMap(store.name)
+		if apierros.IsNotFound(err) {
+			return entries, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		object, data = configMap, configMap.BinaryData
+	}
+	for key, value := range data {
+		entry := &throttleEntry{}
+		if err := json.Unmarshal(value, entry); err == nil {
+			entries[key] = entry
+		}
+	}
+	return entries, object, nil
+}
+
+// Entries from the cache, read again when older than THROTTLE_STORE_CACHE_TTL
+func (store *KubeThrottleStore) cached() (map[string]*throttleEntry, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.cache != nil && time.Since(store.cachedAt) < THROTTLE_STORE_CACHE_TTL {
+		return store.cache, nil
+	}
+	entries, _, err := store.read()
+	if err != nil {
+		return nil, err
+	}
+	store.cache, store.cachedAt = entries, time.Now()
+	return entries, nil
+}
+
+func (store *KubeThrottleStore) setCache(entries map[string]*throttleEntry) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.cache, store.cachedAt = entries, time.Now()
+}
+
+func (store *KubeThrottleStore) Load(key string) (*throttleEntry, error) {
+	entries, err := store.cached()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := entries[store.dataKey(key)]
+	if !ok {
+		return nil, nil
+	}
+	loaded := *entry
+	return &loaded, nil
+}
+
+func (store *KubeThrottleStore) Update(key string, update func(entry *throttleEntry) *throttleEntry) error {
+	dataKey := store.dataKey(key)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		entries, object, err := store.read()
+		if err != nil {
+			return err
+		}
+		entry := update(entries[dataKey])
+		if entry == nil {
+			delete(entries, dataKey)
+		} else {
+			entries[dataKey] = entry
+		}
+		// Drop entries nobody has failed on for a while to keep the object small
+		data := make(map[string][]byte)
+		kept := make(map[string]*throttleEntry)
+		for key, entry := range entries {
+			if !entry.expired(store.retention) {
+				data[key], _ = json.Marshal(entry)
+				kept[key] = entry
+			}
+		}
+		meta := metav1.ObjectMeta{Name: store.name}
+		if object != nil {
+			meta.ResourceVersion = object.GetResourceVersion()
+		}
+		if store.kind == THROTTLE_STORE_SECRET {
+			secret := &corev1.Secret{ObjectMeta: meta, Data: data}
+			if object == nil {
+				_, err = store.client.CreateSecret(store.name, secret)
+			} else {
+				_, err = store.client.updateSecret(store.name, secret)
+			}
+		} else {
+			configMap := &corev1.ConfigMap{ObjectMeta: meta, BinaryData: data}
+			if object == nil {
+				_, err = store.client.CreateConfigMap(store.name, configMap)
+			} else {
+				_, err = store.client.UpdateConfigMap(store.name, configMap)
+			}
+		}
+		if apierros.IsAlreadyExists(err) {
+			// Created by another replica, retry as an update
+			return apierros.NewConflict(corev1.Resource(store.kind), store.name, err)
+		}
+		if err == nil {
+			store.setCache(kept)
+		}
+		return err
+	})
+}
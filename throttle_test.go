@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_LoginThrottle(t *testing.T) {
+	throttle, err := NewLoginThrottle(ThrottleConfig{
+		MaxFailures:     3,
+		Window:          time.Minute,
+		LockoutDuration: time.Hour,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		PerClientIP:     true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Backoff", func(t *testing.T) {
+		for failures, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+			if delay := throttle.backoff(failures + 1); delay != expected {
+				t.Errorf("Error: backoff after %v failures %v != %v", failures+1, delay, expected)
+			}
+		}
+	})
+	t.Run("Lockout", func(t *testing.T) {
+		if retryAfter := throttle.Check("Alice", "10.0.0.1"); retryAfter != 0 {
+			t.Errorf("Error: throttled before any failure: %v", retryAfter)
+		}
+		throttle.Failure("Alice", "10.0.0.1")
+		if retryAfter := throttle.Check("alice", "10.0.0.2"); retryAfter <= 0 || retryAfter > time.Second {
+			t.Errorf("Error: expected backoff for user, got %v", retryAfter)
+		}
+		throttle.Failure("alice", "10.0.0.1")
+		throttle.Failure("alice", "10.0.0.1")
+		if retryAfter := throttle.Check("bob", "10.0.0.1"); retryAfter < 59*time.Minute {
+			t.Errorf("Error: expected IP lockout, got %v", retryAfter)
+		}
+	})
+	t.Run("Success Clears User", func(t *testing.T) {
+		throttle.Success("ALICE")
+		if retryAfter := throttle.Check("alice", "10.0.0.2"); retryAfter != 0 {
+			t.Errorf("Error: user still throttled after success: %v", retryAfter)
+		}
+		if retryAfter := throttle.Check("alice", "10.0.0.1"); retryAfter == 0 {
+			t.Error("Error: IP lockout cleared by user success")
+		}
+	})
+	t.Run("Guard Uses Canonical Username", func(t *testing.T) {
+		// DOMAIN\carol, carol@example.com and carol all fail as carol
+		for _, ip := range []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"} {
+			throttle.Failure("carol", ip)
+		}
+		if retryAfter := throttle.Check(`EXAMPLE\carol`, "10.0.1.4"); retryAfter != 0 {
+			t.Errorf("Error: typed username throttled before LDAP: %v", retryAfter)
+		}
+		err := throttle.guard("10.0.1.4")("carol")
+		throttled, ok := err.(*ThrottledError)
+		if !ok || throttled.RetryAfter < 59*time.Minute {
+			t.Errorf("Error: canonical username not locked out: %v", err)
+		}
+	})
+}
+
+func Test_LoginThrottleSharedIP(t *testing.T) {
+	// Default settings behind an ingress, every request comes from the ingress address
+	throttle, err := NewLoginThrottle(ThrottleConfig{
+		MaxFailures:     3,
+		Window:          time.Minute,
+		LockoutDuration: time.Hour,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		throttle.Failure("mallory", "10.0.0.1")
+	}
+	if retryAfter := throttle.Check("mallory", "10.0.0.1"); retryAfter < 59*time.Minute {
+		t.Errorf("Error: expected user lockout, got %v", retryAfter)
+	}
+	if retryAfter := throttle.Check("alice", "10.0.0.1"); retryAfter != 0 {
+		t.Errorf("Error: alice locked out by failures of mallory: %v", retryAfter)
+	}
+	if err := throttle.guard("10.0.0.1")("alice"); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	throttle.Success("alice")
+}
+
+func Test_KubeThrottleStoreCache(t *testing.T) {
+	// No client, so any read of the Secret would panic
+	store := &KubeThrottleStore{kind: THROTTLE_STORE_SECRET, name: THROTTLE_STORE_NAME}
+	key := THROTTLE_KEY_USER + "alice"
+	store.setCache(map[string]*throttleEntry{store.dataKey(key): {Failures: 2}})
+	for i := 0; i < 3; i++ {
+		entry, err := store.Load(key)
+		if err != nil || entry == nil || entry.Failures != 2 {
+			t.Fatalf("Error: %+v %v", entry, err)
+		}
+		entry.Failures = 5
+	}
+	if entry, _ := store.Load(THROTTLE_KEY_IP + "10.0.0.1"); entry != nil {
+		t.Errorf("Error: %+v", entry)
+	}
+}
@@ -3,18 +3,32 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	apierros "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type Proxy struct {
-	LDAPAuth          *LDAPAuth
-	KubeClient        *KubeClient
-	Config            *MainConfig
-	certificaeStorage *CertificateStorage
+	LDAPAuth              *LDAPAuth
+	KubeClient            *KubeClient
+	Config                *MainConfig
+	clusters              []*Cluster
+	clientCertificateAuth *ClientCertificateAuth
+	loginThrottle         *LoginThrottle
+	rateLimiter           *RateLimiter
+	groupMapping          *GroupMapping
+	headerPolicy          *HeaderPolicy
+	nestedImpersonation   *NestedImpersonation
 }
 
 func (proxy *Proxy) StartProxy(config ProxyConfig) error {
@@ -23,31 +37,117 @@ func (proxy *Proxy) StartProxy(config ProxyConfig) error {
 	http.HandleFunc("/", proxy.auth())
 	hostString := fmt.Sprintf("%s:%s", config.Host, config.Port)
 	// If we have TLS Certificates tart in TLS Mode
-	if _, err := os.Stat(config.TLS.Certificate); err == nil {
-		if _, err := os.Stat(config.TLS.Key); err == nil {
-			log.Printf("Proxy TLS on %v", hostString)
-			return http.ListenAndServeTLS(hostString, config.TLS.Certificate, config.TLS.Key, nil)
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if hasTLSCertificates(config.TLS) {
+		reloader, err := NewCertificateReloader(config.TLS)
+		if err != nil {
+			return err
+		}
+		getCertificate = reloader.GetCertificate
+	} else if config.TLS.SelfSigned.Enabled {
+		// Generate our own CA and certificate and publish the CA for clients to pin
+		selfSigned, err := NewSelfSignedCertificate(proxy.KubeClient, config.TLS.SelfSigned)
+		if err != nil {
+			return err
+		}
+		http.HandleFunc(SELF_SIGNED_CA_PATH, selfSigned.serveCA)
+		getCertificate = selfSigned.GetCertificate
+	}
+	if getCertificate != nil {
+		server := &http.Server{
+			Addr: hostString,
+			// Certificates are looked up per connection so renewed certificates are picked up
+			TLSConfig: &tls.Config{GetCertificate: getCertificate},
 		}
+		if len(config.TLS.ClientAuth.CA) > 0 {
+			// Client certificates are optional, users without one fall back to Basic Auth
+			clientCertificateAuth, err := NewClientCertificateAuth(config.TLS.ClientAuth, proxy.LDAPAuth)
+			if err != nil {
+				return err
+			}
+			proxy.clientCertificateAuth = clientCertificateAuth
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			server.TLSConfig.ClientCAs = clientCertificateAuth.caCertPool
+		}
+		log.Printf("Proxy TLS on %v", hostString)
+		return server.ListenAndServeTLS("", "")
+	}
+	if len(config.TLS.ClientAuth.CA) > 0 {
+		log.Printf("@E Proxy.TLS.ClientAuth.CA ignored, client certificates require TLS")
 	}
 	log.Printf("Proxy on %v", hostString)
 	return http.ListenAndServe(hostString, nil)
 }
 
+func hasTLSCertificates(config TLSConfig) bool {
+	if len(config.SNI) > 0 {
+		return true
+	}
+	if _, err := os.Stat(config.Certificate); err == nil {
+		if _, err := os.Stat(config.Key); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Good Documentation:
 // https://www.alexedwards.net/blog/basic-authentication-in-go
 // https://medium.com/@matryer/the-http-handler-wrapper-technique-in-golang-updated-bc7fbcffa702
 func (proxy *Proxy) auth() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Verified client certificates are used instead of a password
+		if proxy.clientCertificateAuth != nil && hasClientCertificate(r) {
+			user, err := proxy.clientCertificateAuth.Authenticate(r)
+			if err != nil {
+				log.Printf("Client Certificate Error %+v", err)
+				http.Error(w, "Internal Server Error ", http.StatusInternalServerError)
+				return
+			}
+			if user == nil {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			proxy.serve(w, r, user)
+			return
+		}
 		// http Handler function for Basic Auth
 		username, password, ok := r.BasicAuth()
 		if ok {
+			// Reject throttled users and clients without asking LDAP
+			var clientIP string
+			var guard loginGuard
+			if proxy.loginThrottle != nil {
+				clientIP = proxy.loginThrottle.clientIP(r)
+				if retryAfter := proxy.loginThrottle.Check(username, clientIP); retryAfter > 0 {
+					writeThrottled(w, username, clientIP, retryAfter)
+					return
+				}
+				guard = proxy.loginThrottle.guard(clientIP)
+			}
 			// Test Login with LDAP
-			user, err := proxy.LDAPAuth.TestLogin(username, password)
+			user, canonical, err := proxy.LDAPAuth.TestLogin(username, password, guard)
+			var throttled *ThrottledError
+			if errors.As(err, &throttled) {
+				writeThrottled(w, throttled.Username, clientIP, throttled.RetryAfter)
+				return
+			}
 			if err != nil {
 				log.Printf("LDAP Error %+v", err)
 				http.Error(w, "Internal Server Error ", http.StatusInternalServerError)
 				return
 			}
+			if proxy.loginThrottle != nil {
+				// Failures count for the user however the username was typed
+				if len(canonical) == 0 {
+					canonical = username
+				}
+				if user == nil {
+					proxy.loginThrottle.Failure(canonical, clientIP)
+				} else {
+					proxy.loginThrottle.Success(canonical)
+				}
+			}
 			if user == nil {
 				log.Printf("LDAP Login Failed for user %+v", username)
 				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -55,7 +155,7 @@ func (proxy *Proxy) auth() http.HandlerFunc {
 				return
 			}
 			// If login ok Serve.
-			proxy.proxy(w, r, user)
+			proxy.serve(w, r, user)
 		} else {
 			log.Printf("Basic Auth not read correctly %+v", r.Header)
 			w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
@@ -65,9 +165,62 @@ func (proxy *Proxy) auth() http.HandlerFunc {
 	})
 }
 
-var removeRequestHeaderKeys = [...]string{
-	"Authorization",
-	"Accept-Encoding",
+func writeThrottled(w http.ResponseWriter, username string, clientIP string, retryAfter time.Duration) {
+	log.Printf("Login throttled for user %v from %v", username, clientIP)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// Map groups and apply per user and group limits before proxying
+func (proxy *Proxy) serve(w http.ResponseWriter, r *http.Request, user *LDAPUser) {
+	kubernetesUser, err := proxy.Config.Identity.kubernetesUser(user.User)
+	if err != nil {
+		writeStatus(w, apierros.NewForbidden(schema.GroupResource{Resource: "users"}, user.User, err))
+		return
+	}
+	user.KubernetesUser = kubernetesUser
+	cluster := proxy.selectCluster(r)
+	if cluster == nil {
+		writeStatus(w, apierros.NewNotFound(schema.GroupResource{Resource: "clusters"}, r.Host))
+		return
+	}
+	if !cluster.allows(user) {
+		log.Printf("@I User %v is not allowed on cluster %v\n", user.User, cluster.Name)
+		writeStatus(w, apierros.NewForbidden(schema.GroupResource{Resource: "clusters"}, cluster.Name, fmt.Errorf("user %v is not a member of an allowed group", user.User)))
+		return
+	}
+	user.Groups = proxy.kubernetesGroups(user)
+	if target := requestedImpersonation(r); target != nil {
+		err := proxy.nestedImpersonation.Authorize(user, target)
+		if err != nil {
+			log.Printf("@S Impersonation denied for %v as %v %v: %v", user.User, target.User, target.Groups, err)
+			writeStatus(w, apierros.NewForbidden(schema.GroupResource{Resource: "users"}, target.User, err))
+			return
+		}
+		log.Printf("@I Impersonation by %v as %v %v %v %v", user.User, target.User, target.Groups, r.Method, r.URL.Path)
+		user.Target = target
+	}
+	if proxy.rateLimiter != nil {
+		release, retryAfter, err := proxy.rateLimiter.Acquire(user, isLongRunning(r))
+		if err != nil {
+			log.Printf("Rate limited %v %v %v: %v", user.User, r.Method, r.URL.Path, err)
+			writeStatus(w, apierros.NewTooManyRequests(err.Error(), int(math.Ceil(retryAfter.Seconds()))))
+			return
+		}
+		defer release()
+	}
+	proxy.proxy(w, r, user, cluster)
+}
+
+// Mapped LDAP groups and the KubernetesGroups of the access group
+func (proxy *Proxy) kubernetesGroups(user *LDAPUser) []string {
+	groups := proxy.groupMapping.Map(user.User, user.LDAPGroups)
+	for _, group := range proxy.accessGroup(user).KubernetesGroups {
+		if !slices.Contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
 }
 
 // BAD NON FUNCTIONAL DOCS... but a start
@@ -75,17 +228,33 @@ var removeRequestHeaderKeys = [...]string{
 // Good examples:
 // https://stackoverflow.com/questions/34724160/go-http-send-incoming-http-request-to-an-other-server-using-client-do
 
-func (proxy *Proxy) proxy(w http.ResponseWriter, r *http.Request, user *LDAPUser) {
+func (proxy *Proxy) proxy(w http.ResponseWriter, r *http.Request, user *LDAPUser, cluster *Cluster) {
 	if user != nil {
-		tLSClientConfig := &tls.Config{
-			RootCAs: proxy.KubeClient.caCertPool,
-		}
-		if proxy.certificaeStorage != nil {
+		transport := cluster.KubeClient.transport
+		mode := proxy.userMode(cluster, user)
+		var token string
+		if mode == MODE_FRONTPROXY {
+			transport = cluster.KubeClient.frontProxyTransport
+		} else if mode == MODE_SERVICEACCOUNT {
+			var err error
+			token, err = cluster.serviceAccounts.GetToken(user)
+			if err != nil {
+				log.Printf("Error getting ServiceAccount token : %+v\n", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			transport = cluster.KubeClient.tokenTransport
+		} else if mode == MODE_CERTIFICATE {
 			// Get an auth certificate either from Secret og new Certitificate
-			cert, err := proxy.certificaeStorage.GetCertificate(user.User)
+			cert, err := cluster.certificaeStorage.GetCertificate(user.User, user.KubernetesUser, user.Groups, proxy.userCertificateLifetime(user))
 			//cert, err := NewClientAuth(proxy.KubeClient, username)
 			if err != nil {
 				log.Printf("Error creating certificate : %+v\n", err)
+				var csrError *CSRError
+				if errors.As(err, &csrError) {
+					writeStatus(w, csrStatus(csrError))
+					return
+				}
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -95,18 +264,10 @@ func (proxy *Proxy) proxy(w http.ResponseWriter, r *http.Request, user *LDAPUser
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			} else {
-				tLSClientConfig.Certificates = []tls.Certificate{tlsCert}
-			}
-		} else {
-			if proxy.KubeClient.certificate != nil {
-				tLSClientConfig.Certificates = []tls.Certificate{*proxy.KubeClient.certificate}
+				transport = cluster.KubeClient.userTransport(tlsCert)
 			}
 		}
-		httpClient := &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tLSClientConfig,
-			},
-		}
+		httpClient := &http.Client{Transport: transport}
 		// Setup HTTP Client from Certificate and CA
 		// Read body to proxy
 		body, err := io.ReadAll(r.Body)
@@ -118,51 +279,49 @@ func (proxy *Proxy) proxy(w http.ResponseWriter, r *http.Request, user *LDAPUser
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// Create a URL from request
-		url := fmt.Sprintf("%s://%s%s", "https", proxy.Config.Kubernetes.Host, r.RequestURI)
-		// Create new Request
-		proxyReq, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
-		// Adding headers
-		proxyReq.Header = make(http.Header)
-		for headerKey, headerValue := range r.Header {
-			skip := false
-			for _, testKey := range removeRequestHeaderKeys {
-				if headerKey == testKey {
-					skip = true
+		// Create new Request for each API server tried
+		newRequest := func(server string) (*http.Request, error) {
+			// Create a URL from request, server may have a path prefix
+			url := server + r.RequestURI
+			proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, url, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			// Adding headers the client is allowed to send
+			proxyReq.Header = proxy.headerPolicy.Filter(r.Header)
+			// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
+			// Credentials of the proxy are added by the transport
+			if mode == MODE_IMPERSONATION {
+				if user.Target != nil {
+					setNestedImpersonation(proxyReq.Header, user)
+				} else {
+					setImpersonation(proxyReq.Header, user)
 				}
+				return proxyReq, nil
 			}
-			if !skip {
-				// f headerValue
-				proxyReq.Header[headerKey] = headerValue
+			if mode == MODE_FRONTPROXY {
+				setFrontProxyHeaders(proxyReq.Header, cluster.FrontProxy, user)
 			}
-		}
-		// Setting impersonation headders
-		// https://kubernetes.io/docs/reference/access-authn-authz/authentication/#user-impersonation
-		if proxy.certificaeStorage == nil {
-			if proxy.KubeClient.bearerToken != nil {
-				proxyReq.Header["Authorization"] = []string{"Bearer " + *proxy.KubeClient.bearerToken}
+			if mode == MODE_SERVICEACCOUNT {
+				proxyReq.Header["Authorization"] = []string{"Bearer " + token}
 			}
-			proxyReq.Header["Impersonate-User"] = []string{user.User}
-			proxyReq.Header["Impersonate-Group"] = user.Groups
+			if user.Target != nil {
+				setCertificateImpersonation(proxyReq.Header, user)
+			}
+			return proxyReq, nil
 		}
 
 		// Do Request
-		proxyResp, err := httpClient.Do(proxyReq)
+		proxyResp, done, err := cluster.endpoints.Do(httpClient, r.Method, newRequest)
 		if err != nil {
 			log.Printf("I %v %v %v %+v", user.User, r.Method, r.URL.Path, err)
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
-		// Read body to return
+		defer done()
 		defer proxyResp.Body.Close()
-		proxyBody, err := io.ReadAll(proxyResp.Body)
 		if proxy.Config.Verbose {
-			log.Printf("< %v %v %v %v %+v %v\n- %+v", user.User, r.Method, r.URL.Path, proxyResp.StatusCode, proxyResp.Status, len(proxyBody), proxyResp.Header)
-		}
-		if err != nil {
-			log.Printf("Error reading proxy body: %+v", err)
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
+			log.Printf("< %v %v %v %v %+v\n- %+v", user.User, r.Method, r.URL.Path, proxyResp.StatusCode, proxyResp.Status, proxyResp.Header)
 		}
 		// Copy response headers
 		respH := w.Header()
@@ -170,8 +329,24 @@ func (proxy *Proxy) proxy(w http.ResponseWriter, r *http.Request, user *LDAPUser
 		for key, value := range proxyResp.Header {
 			respH[key] = value
 		}
-		// Write body and statuscode.
+		// Write statuscode and stream the body, watches and logs are flushed as they arrive
 		w.WriteHeader(proxyResp.StatusCode)
-		w.Write(proxyBody)
+		_, err = io.Copy(flushWriter{w}, proxyResp.Body)
+		if err != nil && r.Context().Err() == nil {
+			log.Printf("Error reading proxy body: %+v", err)
+		}
+	}
+}
+
+// Flushes after every write so streamed responses are not held back
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if flusher, ok := fw.w.(http.Flusher); ok {
+		flusher.Flush()
 	}
+	return n, err
 }